@@ -11,7 +11,7 @@ func main() {
 		log.Fatalf("failed to initialize application: %v", err)
 	}
 
-	err = app.Engine.Run(":" + app.Config.Port)
+	err = app.Run()
 	if err != nil {
 		log.Fatal("error running server: ", err)
 	}
@@ -1,10 +1,17 @@
 package initializer
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
 	"test-task/internal/config"
 	db "test-task/internal/database"
+	"test-task/internal/middleware"
 	"test-task/internal/modules/auth"
+	"test-task/internal/modules/oauth"
 	"test-task/internal/routes"
+	"test-task/pkg/utils"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -12,10 +19,14 @@ import (
 )
 
 type AppWrapper struct {
-	Engine   *gin.Engine
-	Config   *config.Config
-	Database *db.DBHandler
-	Router   *routes.AppRouter
+	Engine    *gin.Engine
+	Config    *config.Config
+	Database  *db.DBHandler
+	Router    *routes.AppRouter
+	ClientIPs utils.ClientIPResolver
+	// Cleanup deletes expired tokens, codes and proofs, Run calls it every
+	// CLEANUP_INTERVAL
+	Cleanup func() error
 }
 
 func InitializeApp() (*AppWrapper, error) {
@@ -24,23 +35,57 @@ func InitializeApp() (*AppWrapper, error) {
 		return nil, err
 	}
 
+	clientIPs, err := clientIPResolver(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	dbHandler := db.InitDB(cfg.DBSource)
-	app := setupGin(cfg)
+	app, err := setupGin(cfg, clientIPs)
+	if err != nil {
+		return nil, err
+	}
 
 	router := routes.NewAppRouter(app, "/api", "/v1")
-	err = InitializeModule(dbHandler, cfg, auth.InitAuthService, auth.NewHandler, router.RegisterAuthRoutes)
+	authService, err := InitializeModule(dbHandler, cfg, auth.InitAuthService, auth.NewHandler, router.RegisterAuthRoutes)
+	if err != nil {
+		return nil, err
+	}
+
+	initOAuthService := func(dbHandler db.DBHandler, cfg *config.Config) (*oauth.Service, error) {
+		return oauth.InitOAuthService(dbHandler, cfg, authService)
+	}
+	oauthService, err := InitializeModule(dbHandler, cfg, initOAuthService, oauth.NewHandler, router.RegisterOAuthRoutes)
 	if err != nil {
 		return nil, err
 	}
 
 	return &AppWrapper{
-		Engine:   app,
-		Config:   cfg,
-		Database: &dbHandler,
-		Router:   router,
+		Engine:    app,
+		Config:    cfg,
+		Database:  &dbHandler,
+		Router:    router,
+		ClientIPs: clientIPs,
+		Cleanup:   oauthService.CleanupExpiredTokens,
 	}, nil
 }
 
+// Run serves the app on the configured port. With PROXY_PROTOCOL the
+// listener reads the client address from the header trusted proxies send.
+func (a *AppWrapper) Run() error {
+	listener, err := net.Listen("tcp", ":"+a.Config.Port)
+	if err != nil {
+		return err
+	}
+	if a.Cleanup != nil && a.Config.CleanupInterval > 0 {
+		go utils.RunPeriodically(context.Background(), "cleanup of expired tokens", a.Config.CleanupInterval, a.Cleanup)
+	}
+	if a.Config.ProxyProtocol {
+		listener = &utils.ProxyProtocolListener{Listener: listener, Trusted: a.ClientIPs.Trusted}
+	}
+	return a.Engine.RunListener(listener)
+}
+
 // generic service initializer
 type Service interface{}
 type Handler interface{}
@@ -50,34 +95,58 @@ func InitializeModule[T Service, H Handler](
 	cfg *config.Config,
 	initService func(dbHandler db.DBHandler, cfg *config.Config) (T, error),
 	createHandler func(T, *config.Config) H,
-	registerRoutes func(H)) error {
+	registerRoutes func(H)) (T, error) {
 
 	service, err := initService(dbHandler, cfg)
 	if err != nil {
-		return err
+		return service, err
 	}
 
 	handler := createHandler(service, cfg)
 
 	registerRoutes(handler)
-	return nil
+	return service, nil
 }
 
-// cors configuration
+// cors configuration. Browser clients send DPoP proofs and read why a bound
+// token was refused from WWW-Authenticate.
 func CorsConfig(cfg *config.Config) gin.HandlerFunc {
 	return cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "DPoP"},
+		ExposeHeaders:    []string{"Content-Length", "WWW-Authenticate"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	})
 }
 
+func clientIPResolver(cfg *config.Config) (utils.ClientIPResolver, error) {
+	proxies, err := utils.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return utils.ClientIPResolver{}, err
+	}
+
+	supported := false
+	for _, header := range []string{utils.HeaderXForwardedFor, utils.HeaderForwarded, utils.HeaderXRealIP} {
+		supported = supported || strings.EqualFold(cfg.ClientIPHeader, header)
+	}
+	if !supported {
+		return utils.ClientIPResolver{}, fmt.Errorf("unsupported CLIENT_IP_HEADER %q", cfg.ClientIPHeader)
+	}
+
+	return utils.ClientIPResolver{TrustedProxies: proxies, Header: cfg.ClientIPHeader}, nil
+}
+
 // gin setup
-func setupGin(cfg *config.Config) *gin.Engine {
+func setupGin(cfg *config.Config, clientIPs utils.ClientIPResolver) (*gin.Engine, error) {
 	app := gin.New()
+	// the client address is resolved by our own middleware, gin must not
+	// believe forwarding headers on its own
+	if err := app.SetTrustedProxies(nil); err != nil {
+		return nil, err
+	}
+	app.Use(middleware.ResolveClientIP(clientIPs))
 	app.Use(CorsConfig(cfg))
 
 	if gin.Mode() == gin.DebugMode {
@@ -86,5 +155,5 @@ func setupGin(cfg *config.Config) *gin.Engine {
 
 	app.Use(gin.Recovery())
 
-	return app
+	return app, nil
 }
@@ -3,19 +3,112 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Port         string `mapstructure:"PORT"`
-	JWTSecretKey string `mapstructure:"JWT_SECRET_KEY"`
-	DBSource     string `mapstructure:"DB_SOURCE"`
+	Port              string `mapstructure:"PORT"`
+	JWTSecretKey      string `mapstructure:"JWT_SECRET_KEY"`
+	JWTSigningAlg     string `mapstructure:"JWT_SIGNING_ALG"`
+	JWTKeyID          string `mapstructure:"JWT_KEY_ID"`
+	JWTPrivateKeyFile string `mapstructure:"JWT_PRIVATE_KEY_FILE"`
+
+	// PublicURL is where clients reach the service, e.g. https://id.example.com.
+	// Discovery falls back to the host of the request when it is empty.
+	PublicURL string `mapstructure:"PUBLIC_URL"`
+
+	// TrustedProxies are the CIDR ranges of the load balancers in front of
+	// the service. Only their ClientIPHeader, X-Forwarded-For, Forwarded or
+	// X-Real-IP, is believed, and only they may send a PROXY protocol header
+	// when ProxyProtocol is on.
+	TrustedProxies []string `mapstructure:"TRUSTED_PROXIES"`
+	ClientIPHeader string   `mapstructure:"CLIENT_IP_HEADER"`
+	ProxyProtocol  bool     `mapstructure:"PROXY_PROTOCOL"`
+
+	JWTIssuer    string        `mapstructure:"JWT_ISSUER"`
+	JWTAudiences []string      `mapstructure:"JWT_AUDIENCES"`
+	JWTLeeway    time.Duration `mapstructure:"JWT_LEEWAY"`
+
+	AccessTokenIPBinding bool `mapstructure:"ACCESS_TOKEN_IP_BINDING"`
+	// IPBindingMode is strict, same_subnet, warn_only or off. Subnets are
+	// compared with the IPv4 and IPv6 prefix lengths below.
+	IPBindingMode       string `mapstructure:"IP_BINDING_MODE"`
+	IPBindingIPv4Prefix int    `mapstructure:"IP_BINDING_IPV4_PREFIX"`
+	IPBindingIPv6Prefix int    `mapstructure:"IP_BINDING_IPV6_PREFIX"`
+	// DPoPProofLifetime is how far the iat of a DPoP proof may lie from now
+	DPoPProofLifetime time.Duration `mapstructure:"DPOP_PROOF_LIFETIME"`
+
+	// UserScopes are granted to every user on top of the permissions their
+	// roles hold
+	UserScopes []string `mapstructure:"USER_SCOPES"`
+
+	// EmailVerification is off, limited or required. In limited mode users
+	// whose address is not verified yet only get UnverifiedUserScopes, in
+	// required mode they cannot sign in at all.
+	EmailVerification    string   `mapstructure:"EMAIL_VERIFICATION"`
+	UnverifiedUserScopes []string `mapstructure:"UNVERIFIED_USER_SCOPES"`
+	// EmailVerificationURL is the page the link in verification emails points
+	// to, it receives the token as the token query parameter. Without it the
+	// email carries the bare token.
+	EmailVerificationURL            string        `mapstructure:"EMAIL_VERIFICATION_URL"`
+	EmailVerificationTTL            time.Duration `mapstructure:"EMAIL_VERIFICATION_TTL"`
+	EmailVerificationResendInterval time.Duration `mapstructure:"EMAIL_VERIFICATION_RESEND_INTERVAL"`
+
+	// PasswordMinLength counts characters and PasswordMaxLength bytes, at most
+	// the 72 bcrypt hashes. PasswordRequiredClasses names character classes
+	// every password needs: lowercase, uppercase, digit or symbol.
+	PasswordMinLength       int      `mapstructure:"PASSWORD_MIN_LENGTH"`
+	PasswordMaxLength       int      `mapstructure:"PASSWORD_MAX_LENGTH"`
+	PasswordRequiredClasses []string `mapstructure:"PASSWORD_REQUIRED_CLASSES"`
+	PasswordBannedWords     []string `mapstructure:"PASSWORD_BANNED_WORDS"`
+	// PasswordMinStrength is the lowest strength score, 0 to 4, accepted
+	PasswordMinStrength int `mapstructure:"PASSWORD_MIN_STRENGTH"`
+	// PasswordBreachedCorpusDir holds Have I Been Pwned range files that new
+	// passwords are checked against; the check is off while it is empty
+	PasswordBreachedCorpusDir string `mapstructure:"PASSWORD_BREACHED_CORPUS_DIR"`
+	PasswordBreachedMinCount  int    `mapstructure:"PASSWORD_BREACHED_MIN_COUNT"`
+
+	// PasswordResetURL is the page the link in password reset emails points to,
+	// like EmailVerificationURL
+	PasswordResetURL string        `mapstructure:"PASSWORD_RESET_URL"`
+	PasswordResetTTL time.Duration `mapstructure:"PASSWORD_RESET_TTL"`
+
+	// Emails are written to the log while SMTPHost is empty
+	SMTPHost     string `mapstructure:"SMTP_HOST"`
+	SMTPPort     string `mapstructure:"SMTP_PORT"`
+	SMTPFrom     string `mapstructure:"SMTP_FROM"`
+	SMTPPassword string `mapstructure:"SMTP_PASSWORD"`
+
+	JWTKeyEncryptionKey   string        `mapstructure:"JWT_KEY_ENCRYPTION_KEY"`
+	JWTKeyRetirementGrace time.Duration `mapstructure:"JWT_KEY_RETIREMENT_GRACE"`
+	JWTKeyRefreshInterval time.Duration `mapstructure:"JWT_KEY_REFRESH_INTERVAL"`
+
+	DBSource           string `mapstructure:"DB_SOURCE"`
+	MaxSessionsPerUser int    `mapstructure:"MAX_SESSIONS_PER_USER"`
+	AdminAPIKeys       string `mapstructure:"ADMIN_API_KEYS"`
+
+	// ClientRegistrationTokens are the initial access tokens of dynamic client
+	// registration, name:token pairs like AdminAPIKeys. Registration is
+	// disabled while it is empty.
+	ClientRegistrationTokens string `mapstructure:"CLIENT_REGISTRATION_TOKENS"`
+
+	LoginSessionTTL time.Duration `mapstructure:"LOGIN_SESSION_TTL"`
+	// ServiceAccountSecretOverlap is how long the previous secret of a service
+	// account keeps working after it was rotated
+	ServiceAccountSecretOverlap time.Duration `mapstructure:"SERVICE_ACCOUNT_SECRET_OVERLAP"`
+
+	// CleanupInterval is how often expired tokens, codes and proofs are
+	// deleted
+	CleanupInterval time.Duration `mapstructure:"CLEANUP_INTERVAL"`
 }
 
 func LoadConfig(file string) (*Config, error) {
 	viper.SetConfigFile(file)
 	viper.AutomaticEnv()
+	setDefaults()
 
 	if _, err := os.Stat(file); os.IsNotExist(err) {
 		fmt.Printf("Configuration file %s does not exist, falling back to environment variables\n", file)
@@ -48,3 +141,74 @@ func LoadConfig(file string) (*Config, error) {
 
 	return &config, nil
 }
+
+// defaults also register the keys with viper, so AutomaticEnv picks them up
+// during Unmarshal even when they are missing from the config file
+func setDefaults() {
+	viper.SetDefault("JWT_SIGNING_ALG", "HS512")
+	viper.SetDefault("JWT_KEY_ID", "")
+	viper.SetDefault("JWT_PRIVATE_KEY_FILE", "")
+	viper.SetDefault("JWT_ISSUER", "test-task")
+	viper.SetDefault("JWT_AUDIENCES", []string{"test-task"})
+	viper.SetDefault("JWT_LEEWAY", 30*time.Second)
+	viper.SetDefault("PUBLIC_URL", "")
+	viper.SetDefault("TRUSTED_PROXIES", []string{})
+	viper.SetDefault("CLIENT_IP_HEADER", "X-Forwarded-For")
+	viper.SetDefault("PROXY_PROTOCOL", false)
+	viper.SetDefault("LOGIN_SESSION_TTL", 12*time.Hour)
+	viper.SetDefault("SERVICE_ACCOUNT_SECRET_OVERLAP", 24*time.Hour)
+	viper.SetDefault("CLEANUP_INTERVAL", time.Hour)
+	viper.SetDefault("ACCESS_TOKEN_IP_BINDING", false)
+	viper.SetDefault("IP_BINDING_MODE", "strict")
+	viper.SetDefault("IP_BINDING_IPV4_PREFIX", 24)
+	viper.SetDefault("IP_BINDING_IPV6_PREFIX", 64)
+	viper.SetDefault("DPOP_PROOF_LIFETIME", 5*time.Minute)
+	viper.SetDefault("USER_SCOPES", []string{"openid", "profile", "email", "sessions"})
+	viper.SetDefault("EMAIL_VERIFICATION", "off")
+	viper.SetDefault("UNVERIFIED_USER_SCOPES", []string{"openid", "profile"})
+	viper.SetDefault("EMAIL_VERIFICATION_URL", "")
+	viper.SetDefault("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+	viper.SetDefault("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute)
+	viper.SetDefault("PASSWORD_MIN_LENGTH", 8)
+	viper.SetDefault("PASSWORD_MAX_LENGTH", 72)
+	viper.SetDefault("PASSWORD_REQUIRED_CLASSES", []string{})
+	viper.SetDefault("PASSWORD_BANNED_WORDS", []string{})
+	viper.SetDefault("PASSWORD_MIN_STRENGTH", 2)
+	viper.SetDefault("PASSWORD_BREACHED_CORPUS_DIR", "")
+	viper.SetDefault("PASSWORD_BREACHED_MIN_COUNT", 1)
+	viper.SetDefault("PASSWORD_RESET_URL", "")
+	viper.SetDefault("PASSWORD_RESET_TTL", 30*time.Minute)
+	viper.SetDefault("SMTP_HOST", "")
+	viper.SetDefault("SMTP_PORT", "587")
+	viper.SetDefault("SMTP_FROM", "")
+	viper.SetDefault("SMTP_PASSWORD", "")
+	viper.SetDefault("JWT_KEY_ENCRYPTION_KEY", "")
+	viper.SetDefault("JWT_KEY_RETIREMENT_GRACE", time.Hour)
+	viper.SetDefault("JWT_KEY_REFRESH_INTERVAL", time.Minute)
+	viper.SetDefault("MAX_SESSIONS_PER_USER", 5)
+	viper.SetDefault("ADMIN_API_KEYS", "")
+	viper.SetDefault("CLIENT_REGISTRATION_TOKENS", "")
+}
+
+// AdminCredentials parses ADMIN_API_KEYS, a comma separated list of
+// name:key pairs, into a map of key to credential name.
+func (c *Config) AdminCredentials() map[string]string {
+	return parseCredentials(c.AdminAPIKeys)
+}
+
+// RegistrationCredentials parses CLIENT_REGISTRATION_TOKENS the same way.
+func (c *Config) RegistrationCredentials() map[string]string {
+	return parseCredentials(c.ClientRegistrationTokens)
+}
+
+func parseCredentials(pairs string) map[string]string {
+	credentials := make(map[string]string)
+	for _, pair := range strings.Split(pairs, ",") {
+		name, key, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found || name == "" || key == "" {
+			continue
+		}
+		credentials[key] = name
+	}
+	return credentials
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"log"
 	"test-task/internal/modules/auth/models"
+	oauthmodels "test-task/internal/modules/oauth/models"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -25,6 +26,22 @@ func InitDB(url string) DBHandler {
 	err = db.AutoMigrate(
 		&models.User{},
 		&models.Token{},
+		&models.SecurityEvent{},
+		&models.RevokedAccessToken{},
+		&models.DPoPProof{},
+		&models.EmailVerification{},
+		&models.PasswordReset{},
+		&models.SigningKey{},
+		&models.Role{},
+		&models.Permission{},
+		&models.UserRole{},
+		&oauthmodels.Client{},
+		&oauthmodels.AuthorizationCode{},
+		&oauthmodels.DeviceCode{},
+		&oauthmodels.LoginSession{},
+		&oauthmodels.Consent{},
+		&oauthmodels.ServiceAccount{},
+		&oauthmodels.ServiceAccountSecret{},
 	)
 	if err != nil {
 		log.Fatalf("error occurred while migration: %s", err)
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"test-task/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	AdminKeyHeader = "X-Admin-Key"
+	// AdminContextKey holds the name of the admin credential that
+	// authenticated the request
+	AdminContextKey = "admin"
+)
+
+// RequireAdminKey only lets through requests carrying one of the admin API
+// keys from the configuration.
+func RequireAdminKey(cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if checkAdminKey(c, cfg) {
+			c.Next()
+		}
+	}
+}
+
+// RequireAdmin accepts either an admin API key or a user access token whose
+// roles grant permission. The admin context key is set in both cases, to the
+// credential name, "user:<id>" or "service_account:<client id>".
+func RequireAdmin(cfg *config.Config, options AuthOptions, permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader(AdminKeyHeader) != "" {
+			if checkAdminKey(c, cfg) {
+				c.Next()
+			}
+			return
+		}
+
+		if !authenticate(c, options) || !checkPermissions(c, []string{permission}) {
+			return
+		}
+
+		principal := CurrentPrincipal(c)
+		if principal.ServiceAccount {
+			c.Set(AdminContextKey, "service_account:"+principal.ClientID)
+		} else {
+			c.Set(AdminContextKey, "user:"+principal.UserID.String())
+		}
+		c.Next()
+	}
+}
+
+func checkAdminKey(c *gin.Context, cfg *config.Config) bool {
+	presented := c.GetHeader(AdminKeyHeader)
+	if presented == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing admin credential"})
+		return false
+	}
+
+	for key, name := range cfg.AdminCredentials() {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(key)) == 1 {
+			c.Set(AdminContextKey, name)
+			return true
+		}
+	}
+
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid admin credential"})
+	return false
+}
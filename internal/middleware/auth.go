@@ -0,0 +1,282 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"test-task/pkg/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// PrincipalContextKey holds the *Principal of an authenticated request
+const PrincipalContextKey = "principal"
+
+// DPoPHeader carries the proof of possession of a DPoP key, RFC 9449
+const DPoPHeader = "DPoP"
+
+var (
+	errMultipleDPoPProofs = fmt.Errorf("%w: only one proof may be sent", utils.ErrInvalidDPoPProof)
+	errDPoPUnsupported    = fmt.Errorf("%w: proofs are not accepted here", utils.ErrInvalidDPoPProof)
+)
+
+// Verifier checks a bearer access token, utils.TokenVerifier implements it.
+type Verifier interface {
+	Verify(tokenString string) (*utils.AccessTokenClaims, error)
+}
+
+// DPoPVerifier checks DPoP proofs, utils.DPoPVerifier implements it.
+type DPoPVerifier interface {
+	Verify(proof, method, requestURL, accessToken string) (string, error)
+	RequestURL(r *http.Request) string
+}
+
+// Principal is the authenticated caller of a request. For service accounts
+// UserID is the ID of the service account.
+type Principal struct {
+	UserID         uuid.UUID
+	SessionID      uuid.UUID
+	ClientID       string
+	ServiceAccount bool
+	TokenID        string
+	Roles          []string
+	Permissions    []string
+	Scopes         []string
+	ExpiresAt      time.Time
+	Claims         *utils.AccessTokenClaims
+
+	// Actor is set when a service acts on the user's behalf with a token
+	// obtained through token exchange
+	Actor *utils.Actor
+}
+
+func (p *Principal) HasRole(role string) bool {
+	return contains(p.Roles, role)
+}
+
+func (p *Principal) HasPermission(permission string) bool {
+	return contains(p.Permissions, permission)
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	return contains(p.Scopes, scope)
+}
+
+type AuthOptions struct {
+	Verifier Verifier
+	// BindIP checks the address tokens are presented from against the one
+	// they were issued to, following IPPolicy. DPoP bound tokens are exempt,
+	// the proof pins them to their holder more precisely.
+	BindIP   bool
+	IPPolicy utils.IPBindingPolicy
+	// DPoP verifies the proofs that must accompany DPoP bound tokens; such
+	// tokens are rejected without it
+	DPoP DPoPVerifier
+}
+
+// Authenticate requires a valid access token and exposes the caller as a
+// Principal to the handlers after it. Tokens bound to a DPoP key must be
+// sent with the DPoP scheme and a proof signed by that key.
+func Authenticate(options AuthOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authenticate(c, options) {
+			c.Next()
+		}
+	}
+}
+
+// authenticate sets the principal of the request, or aborts it and reports
+// false.
+func authenticate(c *gin.Context, options AuthOptions) bool {
+	header := c.GetHeader("Authorization")
+	var tokenString string
+	dpop := false
+	switch {
+	case strings.HasPrefix(header, "Bearer "):
+		tokenString = strings.TrimPrefix(header, "Bearer ")
+	case strings.HasPrefix(header, "DPoP "):
+		tokenString = strings.TrimPrefix(header, "DPoP ")
+		dpop = true
+	}
+	if tokenString == "" {
+		challenge := "Bearer"
+		if options.DPoP != nil {
+			challenge += ", DPoP algs=\"" + strings.Join(utils.DPoPAlgorithms, " ") + "\""
+		}
+		c.Header("WWW-Authenticate", challenge)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing access token"})
+		return false
+	}
+
+	claims, err := options.Verifier.Verify(tokenString)
+	if err != nil {
+		abortUnauthorized(c, "invalid access token")
+		return false
+	}
+
+	bound := claims.Confirmation != nil && claims.Confirmation.JKT != ""
+	if bound != dpop {
+		abortUnauthorized(c, "access token must be sent with the scheme matching its binding")
+		return false
+	}
+	if bound {
+		jkt, err := DPoPKey(c, options.DPoP, tokenString)
+		if err != nil || jkt != claims.Confirmation.JKT {
+			c.Header("WWW-Authenticate", `DPoP error="invalid_dpop_proof"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid DPoP proof"})
+			return false
+		}
+	}
+
+	userID, err := utils.ConvertStringToUUID(claims.UserID)
+	if err != nil {
+		abortUnauthorized(c, "invalid access token")
+		return false
+	}
+
+	if options.BindIP && !bound {
+		decision := options.IPPolicy.Decide(claims.IPAddress, ClientIP(c))
+		if !decision.Allowed() {
+			abortUnauthorized(c, "access token was issued to another IP address")
+			return false
+		}
+		if decision == utils.IPDecisionWarned {
+			log.Printf("access token %s issued to %s presented from %s", claims.ID, claims.IPAddress, ClientIP(c))
+		}
+	}
+
+	principal := &Principal{
+		UserID:         userID,
+		ClientID:       claims.ClientID,
+		ServiceAccount: claims.Kind == utils.KindServiceAccount,
+		TokenID:        claims.ID,
+		Roles:          claims.Roles,
+		Permissions:    claims.Permissions,
+		Scopes:         strings.Fields(claims.Scope),
+		Actor:          claims.Actor,
+		Claims:         claims,
+	}
+	principal.SessionID, _ = uuid.Parse(claims.SessionID)
+	if claims.ExpiresAt != nil {
+		principal.ExpiresAt = claims.ExpiresAt.Time
+	}
+
+	c.Set(PrincipalContextKey, principal)
+	return true
+}
+
+// DPoPKey verifies the DPoP proof of the request and returns the thumbprint of
+// the key that signed it, or an empty string when no proof was sent.
+// accessToken is the token the proof accompanies, empty at token endpoints.
+func DPoPKey(c *gin.Context, verifier DPoPVerifier, accessToken string) (string, error) {
+	proofs := c.Request.Header.Values(DPoPHeader)
+	switch {
+	case len(proofs) == 0:
+		if accessToken != "" {
+			return "", utils.ErrInvalidDPoPProof
+		}
+		return "", nil
+	case len(proofs) > 1:
+		return "", errMultipleDPoPProofs
+	case verifier == nil:
+		return "", errDPoPUnsupported
+	}
+
+	return verifier.Verify(proofs[0], c.Request.Method, verifier.RequestURL(c.Request), accessToken)
+}
+
+// CurrentPrincipal returns the caller set by Authenticate, or nil.
+func CurrentPrincipal(c *gin.Context) *Principal {
+	value, ok := c.Get(PrincipalContextKey)
+	if !ok {
+		return nil
+	}
+	principal, _ := value.(*Principal)
+	return principal
+}
+
+// RequireScope only lets through callers whose token carries every scope.
+func RequireScope(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := CurrentPrincipal(c)
+		if principal == nil {
+			abortUnauthorized(c, "missing access token")
+			return
+		}
+
+		for _, scope := range scopes {
+			if !principal.HasScope(scope) {
+				c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+strings.Join(scopes, " ")+`"`)
+				abortForbidden(c, "insufficient scope")
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// RequireRole only lets through callers holding at least one of the roles.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := CurrentPrincipal(c)
+		if principal == nil {
+			abortUnauthorized(c, "missing access token")
+			return
+		}
+
+		for _, role := range roles {
+			if principal.HasRole(role) {
+				c.Next()
+				return
+			}
+		}
+		abortForbidden(c, "insufficient role")
+	}
+}
+
+// RequirePermission only lets through callers whose roles grant every
+// permission.
+func RequirePermission(permissions ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if checkPermissions(c, permissions) {
+			c.Next()
+		}
+	}
+}
+
+func checkPermissions(c *gin.Context, permissions []string) bool {
+	principal := CurrentPrincipal(c)
+	if principal == nil {
+		abortUnauthorized(c, "missing access token")
+		return false
+	}
+
+	for _, permission := range permissions {
+		if !principal.HasPermission(permission) {
+			abortForbidden(c, "missing permission "+permission)
+			return false
+		}
+	}
+	return true
+}
+
+func abortUnauthorized(c *gin.Context, message string) {
+	c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": message})
+}
+
+func abortForbidden(c *gin.Context, message string) {
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": message})
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"test-task/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClientIPContextKey holds the client address resolved by ResolveClientIP
+const ClientIPContextKey = "client_ip"
+
+// ResolveClientIP resolves the address of the client once per request, so
+// token claims, sessions, binding checks and audit records all agree on it.
+func ResolveClientIP(resolver utils.ClientIPResolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(ClientIPContextKey, resolver.Resolve(c.Request.RemoteAddr, c.Request.Header))
+		c.Next()
+	}
+}
+
+// ClientIP returns the address resolved by ResolveClientIP. Without the
+// middleware no forwarding header is trusted and the peer address is used.
+func ClientIP(c *gin.Context) string {
+	if ip := c.GetString(ClientIPContextKey); ip != "" {
+		return ip
+	}
+	return utils.ClientIPResolver{}.Resolve(c.Request.RemoteAddr, nil)
+}
@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"test-task/internal/config"
+	"test-task/internal/modules/auth/models"
+	"test-task/pkg/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultEmailVerificationTTL            = 24 * time.Hour
+	defaultEmailVerificationResendInterval = time.Minute
+	// maxVerificationEmailsPerDay caps how many emails one account can be
+	// made to send, however patiently the resend interval is waited out
+	maxVerificationEmailsPerDay = 10
+)
+
+var (
+	ErrEmailNotVerified      = errors.New("email address is not verified")
+	ErrVerificationThrottled = errors.New("a verification email was sent recently, try again later")
+)
+
+// EmailVerificationMode is the configured email verification mode.
+func (s *Service) EmailVerificationMode() utils.EmailVerificationMode {
+	mode, err := utils.ParseEmailVerificationMode(s.Config.EmailVerification)
+	if err != nil {
+		return utils.EmailVerificationRequired
+	}
+	return mode
+}
+
+// SignupScopes are the scopes a new account can be granted. It holds no roles
+// and, unless verification is off, has not verified its address yet.
+func (s *Service) SignupScopes() []string {
+	if s.EmailVerificationMode() == utils.EmailVerificationLimited {
+		return s.unverifiedScopes()
+	}
+	return s.Config.UserScopes
+}
+
+// unverifiedScopes are the user scopes an account is limited to until its
+// address is verified.
+func (s *Service) unverifiedScopes() []string {
+	scopes := []string{}
+	for _, scope := range s.Config.UnverifiedUserScopes {
+		if utils.ContainsScope(s.Config.UserScopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// SendVerificationEmail mails the user a signed, single use link that
+// confirms their current address. At most one email is sent per resend
+// interval, and a limited number per day.
+func (s *Service) SendVerificationEmail(user *models.User) error {
+	if user.EmailVerifiedAt != nil {
+		return nil
+	}
+
+	interval := s.Config.EmailVerificationResendInterval
+	if interval <= 0 {
+		interval = defaultEmailVerificationResendInterval
+	}
+	ttl := s.Config.EmailVerificationTTL
+	if ttl <= 0 {
+		ttl = defaultEmailVerificationTTL
+	}
+
+	now := time.Now()
+	var recent, today int64
+	if err := s.Handler.DB.Model(&models.EmailVerification{}).
+		Where("user_id = ? AND created_at > ?", user.ID, now.Add(-interval)).
+		Count(&recent).Error; err != nil {
+		return err
+	}
+	if err := s.Handler.DB.Model(&models.EmailVerification{}).
+		Where("user_id = ? AND created_at > ?", user.ID, now.Add(-24*time.Hour)).
+		Count(&today).Error; err != nil {
+		return err
+	}
+	if recent > 0 || today >= maxVerificationEmailsPerDay {
+		return ErrVerificationThrottled
+	}
+
+	verification := &models.EmailVerification{
+		ID:        uuid.New(),
+		UserID:    user.ID,
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	token, err := utils.GenerateEmailVerificationToken(utils.EmailVerificationParams{
+		ID:      verification.ID.String(),
+		Subject: user.ID.String(),
+		Email:   user.Email,
+		Issuer:  s.Config.JWTIssuer,
+		TTL:     ttl,
+	}, s.Keys)
+	if err != nil {
+		return err
+	}
+	if err := s.Handler.DB.Create(verification).Error; err != nil {
+		return err
+	}
+
+	return s.Mailer.Send(user.Email, "Verify your email address", s.verificationEmailBody(token, ttl))
+}
+
+func (s *Service) verificationEmailBody(token string, ttl time.Duration) string {
+	link := token
+	if s.Config.EmailVerificationURL != "" {
+		link = s.Config.EmailVerificationURL + "?token=" + url.QueryEscape(token)
+	}
+	return fmt.Sprintf("Please confirm your email address with the link below. It expires in %s and can be used once.\n\n%s\n\n"+
+		"If you did not create an account, you can ignore this email.", ttl, link)
+}
+
+// ResendVerificationEmail sends a new verification email to the account
+// with this address. Unknown and already verified addresses are ignored
+// without an error, so the endpoint does not reveal which accounts exist.
+func (s *Service) ResendVerificationEmail(email string) error {
+	var user models.User
+	if err := s.Handler.DB.Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	return s.SendVerificationEmail(&user)
+}
+
+// VerifyEmail consumes a verification token and marks the address it was
+// sent to as verified. Tokens fail once used, once expired, and once the
+// account has changed its address.
+func (s *Service) VerifyEmail(token, ipAddress string) (*models.User, error) {
+	claims, err := utils.VerifyEmailVerificationToken(token, s.Keys, s.Config.JWTIssuer)
+	if err != nil {
+		return nil, err
+	}
+	verificationID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		return nil, utils.ErrInvalidVerificationToken
+	}
+
+	var user models.User
+	err = s.Handler.DB.Transaction(func(tx *gorm.DB) error {
+		var verification models.EmailVerification
+		if err := tx.Where("id = ?", verificationID).First(&verification).Error; err != nil {
+			return utils.ErrInvalidVerificationToken
+		}
+		if verification.UserID.String() != claims.Subject || verification.Email != claims.Email {
+			return utils.ErrInvalidVerificationToken
+		}
+		if err := tx.Where("id = ?", verification.UserID).First(&user).Error; err != nil {
+			return utils.ErrInvalidVerificationToken
+		}
+		if user.Email != verification.Email {
+			return utils.ErrInvalidVerificationToken
+		}
+
+		now := time.Now()
+		// the guard on used_at makes a token that is presented twice at once
+		// succeed only once
+		consumed := tx.Model(&models.EmailVerification{}).
+			Where("id = ? AND used_at IS NULL AND expires_at > ?", verification.ID, now).
+			Update("used_at", now)
+		if consumed.Error != nil {
+			return consumed.Error
+		}
+		if consumed.RowsAffected == 0 {
+			return utils.ErrInvalidVerificationToken
+		}
+
+		if user.EmailVerifiedAt == nil {
+			user.EmailVerifiedAt = &now
+			user.UpdatedAt = now
+			return tx.Model(&user).Updates(map[string]interface{}{
+				"email_verified_at": now,
+				"updated_at":        now,
+			}).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.RecordSecurityEvent(models.SecurityEvent{
+		UserID:    user.ID,
+		Type:      models.SecurityEventEmailVerified,
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("verified %s", user.Email),
+	})
+	return &user, nil
+}
+
+// checkEmailVerified refuses users whose address is not verified while
+// verification is required.
+func (s *Service) checkEmailVerified(user *models.User) error {
+	if user.EmailVerifiedAt == nil && s.EmailVerificationMode() == utils.EmailVerificationRequired {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
+
+func newMailer(cfg *config.Config) utils.Mailer {
+	if cfg.SMTPHost == "" {
+		// outside debug mode the log may be shipped elsewhere, and the links
+		// in the emails must not end up there
+		if gin.Mode() == gin.DebugMode {
+			log.Printf("SMTP_HOST is not set, emails are written to the log")
+			return utils.LogMailer{LogBodies: true}
+		}
+		log.Printf("SMTP_HOST is not set, emails are not sent")
+		return utils.LogMailer{}
+	}
+	return utils.SMTPMailer{From: cfg.SMTPFrom, Password: cfg.SMTPPassword, Host: cfg.SMTPHost, Port: cfg.SMTPPort}
+}
@@ -1,11 +1,19 @@
 package auth
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strings"
 	"test-task/internal/config"
+	"test-task/internal/middleware"
+	"test-task/internal/modules/auth/models"
 	"test-task/pkg/utils"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 type Handler struct {
@@ -24,6 +32,9 @@ func (h *Handler) RegisterUserHandler(c *gin.Context) {
 	var requestBody struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Device   string `json:"device"`
+		Audience string `json:"audience"`
+		Scope    string `json:"scope"`
 	}
 
 	if err := c.BindJSON(&requestBody); err != nil {
@@ -31,40 +42,62 @@ func (h *Handler) RegisterUserHandler(c *gin.Context) {
 		return
 	}
 
-	user, err := h.Service.CreateUser(requestBody.Email, requestBody.Password)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create user"})
+	audience, ok := h.resolveAudience(c, requestBody.Audience)
+	if !ok {
+		return
+	}
+
+	jkt, ok := h.dpopKey(c)
+	if !ok {
 		return
 	}
 
-	ipAddress := c.ClientIP()
-	accessToken, err := utils.GenerateAccessToken(user.ID.String(), ipAddress, h.Config.JWTSecretKey)
+	// a new user holds no roles yet, so only the user scopes can be granted
+	scope, err := utils.NarrowScope(requestBody.Scope, h.Service.SignupScopes())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not generate access token"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	refreshToken, err := utils.GenerateRefreshToken()
+	user, err := h.Service.CreateUser(requestBody.Email, requestBody.Password)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not generate refresh token"})
+		var policyErr *utils.PasswordPolicyError
+		if errors.As(err, &policyErr) {
+			respondPasswordError(c, err)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create user"})
 		return
 	}
 
-	if err := h.Service.SaveRefreshToken(user.ID, refreshToken, ipAddress); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save refresh token"})
+	mode := h.Service.EmailVerificationMode()
+	if mode != utils.EmailVerificationOff {
+		if err := h.Service.SendVerificationEmail(user); err != nil {
+			log.Printf("failed to send verification email to user %s: %v", user.ID, err)
+		}
+	}
+	if mode == utils.EmailVerificationRequired {
+		c.JSON(http.StatusCreated, gin.H{
+			"id":                          user.ID,
+			"email":                       user.Email,
+			"email_verification_required": true,
+		})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"access_token":  accessToken,
-		"refresh_token": refreshToken,
-	})
+	info := h.sessionInfo(c, requestBody.Device)
+	info.Scope = scope
+	info.JKT = jkt
+	h.issueTokens(c, user.ID, info, audience)
 }
 
 func (h *Handler) LoginUserHandler(c *gin.Context) {
 	var requestBody struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Device   string `json:"device"`
+		Audience string `json:"audience"`
+		Scope    string `json:"scope"`
 	}
 
 	if err := c.BindJSON(&requestBody); err != nil {
@@ -72,72 +105,437 @@ func (h *Handler) LoginUserHandler(c *gin.Context) {
 		return
 	}
 
+	audience, ok := h.resolveAudience(c, requestBody.Audience)
+	if !ok {
+		return
+	}
+
+	jkt, ok := h.dpopKey(c)
+	if !ok {
+		return
+	}
+
 	userID, err := h.Service.AuthenticateUser(requestBody.Email, requestBody.Password)
 	if err != nil {
+		if errors.Is(err, ErrEmailNotVerified) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid email or password"})
 		return
 	}
 
-	ipAddress := c.ClientIP()
-	accessToken, err := utils.GenerateAccessToken(userID.String(), ipAddress, h.Config.JWTSecretKey)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not generate access token"})
+	scope, ok := h.resolveScope(c, userID, requestBody.Scope)
+	if !ok {
 		return
 	}
 
-	refreshToken, err := utils.GenerateRefreshToken()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not generate refresh token"})
+	info := h.sessionInfo(c, requestBody.Device)
+	info.Scope = scope
+	info.JKT = jkt
+	h.issueTokens(c, userID, info, audience)
+}
+
+func (h *Handler) VerifyEmailHandler(c *gin.Context) {
+	var requestBody struct {
+		Token string `json:"token"`
+	}
+
+	if err := c.BindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
 		return
 	}
 
-	if err := h.Service.SaveRefreshToken(userID, refreshToken, ipAddress); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save refresh token"})
+	user, err := h.Service.VerifyEmail(requestBody.Token, middleware.ClientIP(c))
+	if err != nil {
+		if errors.Is(err, utils.ErrInvalidVerificationToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not verify email"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"access_token":  accessToken,
-		"refresh_token": refreshToken,
+		"id":                user.ID,
+		"email":             user.Email,
+		"email_verified_at": user.EmailVerifiedAt,
 	})
 }
 
+// ResendVerificationHandler answers the same for every address, so it cannot
+// be used to find out which ones are registered.
+func (h *Handler) ResendVerificationHandler(c *gin.Context) {
+	var requestBody struct {
+		Email string `json:"email"`
+	}
+
+	if err := c.BindJSON(&requestBody); err != nil || strings.TrimSpace(requestBody.Email) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	if h.Service.EmailVerificationMode() != utils.EmailVerificationOff {
+		if err := h.Service.ResendVerificationEmail(requestBody.Email); err != nil && !errors.Is(err, ErrVerificationThrottled) {
+			log.Printf("failed to resend verification email: %v", err)
+		}
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "if the address belongs to an unverified account, a verification email is on its way"})
+}
+
+// ForgotPasswordHandler answers the same for every address, so it cannot be
+// used to find out which ones are registered. The email goes out in the
+// background, otherwise the time it takes would tell them apart.
+func (h *Handler) ForgotPasswordHandler(c *gin.Context) {
+	var requestBody struct {
+		Email string `json:"email"`
+	}
+
+	if err := c.BindJSON(&requestBody); err != nil || strings.TrimSpace(requestBody.Email) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	go func(email string) {
+		if err := h.Service.RequestPasswordReset(email); err != nil {
+			log.Printf("failed to send password reset email: %v", err)
+		}
+	}(requestBody.Email)
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "if the address belongs to an account, a password reset email is on its way"})
+}
+
+func (h *Handler) ResetPasswordHandler(c *gin.Context) {
+	var requestBody struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := c.BindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	if err := h.Service.ResetPassword(requestBody.Token, requestBody.Password, middleware.ClientIP(c)); err != nil {
+		respondPasswordError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ChangePasswordHandler lets a signed in user replace their password. The
+// session the request was made with stays signed in either way.
+func (h *Handler) ChangePasswordHandler(c *gin.Context) {
+	var requestBody struct {
+		CurrentPassword      string `json:"current_password"`
+		NewPassword          string `json:"new_password"`
+		SignOutOtherSessions bool   `json:"sign_out_other_sessions"`
+	}
+
+	if err := c.BindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	principal := middleware.CurrentPrincipal(c)
+	if principal.ServiceAccount || principal.Actor != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": ErrPasswordChangeDenied.Error()})
+		return
+	}
+
+	err := h.Service.ChangePassword(principal.UserID, requestBody.CurrentPassword, requestBody.NewPassword,
+		requestBody.SignOutOtherSessions, principal.SessionID, middleware.ClientIP(c))
+	if err != nil {
+		respondPasswordError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// IssueTokensHandler mints a token pair on a user's behalf. It sits behind an
+// admin credential, and every use is recorded with the reason given.
 func (h *Handler) IssueTokensHandler(c *gin.Context) {
-	userIDStr := c.Param("id")
-	ipAddress := c.ClientIP()
+	userID, err := utils.ConvertStringToUUID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	var requestBody struct {
+		Reason           string `json:"reason"`
+		Audience         string `json:"audience"`
+		Scope            string `json:"scope"`
+		ExpiresIn        int64  `json:"expires_in"`
+		RefreshExpiresIn int64  `json:"refresh_expires_in"`
+	}
+
+	if err := c.BindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	if strings.TrimSpace(requestBody.Reason) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reason is required"})
+		return
+	}
+
+	accessTTL := time.Duration(requestBody.ExpiresIn) * time.Second
+	refreshTTL := time.Duration(requestBody.RefreshExpiresIn) * time.Second
+	if accessTTL < 0 || accessTTL > utils.AccessTokenTTL || refreshTTL < 0 || refreshTTL > refreshTokenTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "requested lifetime exceeds the allowed maximum"})
+		return
+	}
+
+	audience, ok := h.resolveAudience(c, requestBody.Audience)
+	if !ok {
+		return
+	}
+
+	if _, err := h.Service.GetUserByID(userID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	scope, ok := h.resolveScope(c, userID, requestBody.Scope)
+	if !ok {
+		return
+	}
+
+	info := h.sessionInfo(c, "issued")
+	info.Scope = scope
+	info.AccessTokenTTL = accessTTL
+	info.RefreshTokenTTL = refreshTTL
+
+	session := h.issueTokens(c, userID, info, audience)
+	if session == nil {
+		return
+	}
+
+	actor := c.GetString(middleware.AdminContextKey)
+	h.Service.RecordSecurityEvent(models.SecurityEvent{
+		UserID:    userID,
+		Type:      models.SecurityEventTokensIssued,
+		Actor:     actor,
+		IPAddress: info.IPAddress,
+		Details: fmt.Sprintf("session %s issued by %s: %s (scope %q, access ttl %s, refresh expires %s)",
+			session.FamilyID, actor, requestBody.Reason, session.Scope, accessTTL, session.ExpiresAt.Format(time.RFC3339)),
+	})
+}
+
+func (h *Handler) RefreshTokensHandler(c *gin.Context) {
+	var requestBody struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		Audience     string `json:"audience"`
+		Scope        string `json:"scope"`
+	}
+
+	if err := c.BindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	audience, ok := h.resolveAudience(c, requestBody.Audience)
+	if !ok {
+		return
+	}
 
-	accessToken, err := utils.GenerateAccessToken(userIDStr, ipAddress, h.Config.JWTSecretKey)
+	jkt, ok := h.dpopKey(c)
+	if !ok {
+		return
+	}
+
+	ipAddress := middleware.ClientIP(c)
+
+	session, err := h.Service.ValidateRefreshToken(requestBody.RefreshToken, requestBody.AccessToken, ipAddress, jkt)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not generate access token"})
+		respondRefreshError(c, err)
 		return
 	}
 
-	refreshToken, err := utils.GenerateRefreshToken()
+	scope, err := h.Service.SessionScope(session, requestBody.Scope)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not generate refresh token"})
+		respondScopeError(c, err)
 		return
 	}
 
-	userID, err := utils.ConvertStringToUUID(userIDStr)
+	newRefreshToken, err := utils.GenerateRefreshToken()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error occurred"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not generate refresh token"})
 		return
 	}
-	if err := h.Service.SaveRefreshToken(userID, refreshToken, ipAddress); err != nil {
+
+	next, err := h.Service.RotateSession(session, newRefreshToken, ipAddress, c.Request.UserAgent())
+	if err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			respondRefreshError(c, err)
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save refresh token"})
 		return
 	}
 
+	newAccessToken, err := h.Service.IssueAccessToken(next, ipAddress, audience, scope)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not generate access token"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"access_token":  accessToken,
-		"refresh_token": refreshToken,
+		"access_token":  newAccessToken,
+		"refresh_token": newRefreshToken,
+		"token_type":    next.TokenType(),
+		"scope":         scope,
 	})
 }
 
-func (h *Handler) RefreshTokensHandler(c *gin.Context) {
+func (h *Handler) LogoutHandler(c *gin.Context) {
+	principal := middleware.CurrentPrincipal(c)
+
+	if principal.SessionID != uuid.Nil {
+		if err := h.Service.RevokeSession(principal.UserID, principal.SessionID); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke session"})
+			return
+		}
+	}
+
+	// covers tokens that carry no session as well
+	if err := h.denyPresentedToken(principal); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke access token"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handler) LogoutAllHandler(c *gin.Context) {
+	principal := middleware.CurrentPrincipal(c)
+
+	if err := h.Service.RevokeAllSessions(principal.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke sessions"})
+		return
+	}
+
+	if err := h.denyPresentedToken(principal); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke access token"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handler) ListSessionsHandler(c *gin.Context) {
+	principal := middleware.CurrentPrincipal(c)
+
+	tokens, err := h.Service.ListSessions(principal.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list sessions"})
+		return
+	}
+
+	sessions := make([]models.Session, 0, len(tokens))
+	for i := range tokens {
+		sessions = append(sessions, tokens[i].ToSession(principal.SessionID))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+func (h *Handler) RevokeSessionHandler(c *gin.Context) {
+	principal := middleware.CurrentPrincipal(c)
+
+	sessionID, err := utils.ConvertStringToUUID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return
+	}
+
+	if err := h.Service.RevokeSession(principal.UserID, sessionID); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke session"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// AuthOptions describes how requests are authenticated with the access
+// tokens this service issues.
+func (h *Handler) AuthOptions() middleware.AuthOptions {
+	return middleware.AuthOptions{
+		Verifier: h.Service.Verifier(),
+		BindIP:   h.Config.AccessTokenIPBinding,
+		IPPolicy: h.Service.IPBindingPolicy(),
+		DPoP:     h.Service.DPoPVerifier(),
+	}
+}
+
+func (h *Handler) Authenticator() gin.HandlerFunc {
+	return middleware.Authenticate(h.AuthOptions())
+}
+
+func (h *Handler) denyPresentedToken(principal *middleware.Principal) error {
+	if principal.TokenID == "" || principal.ExpiresAt.IsZero() {
+		return nil
+	}
+	return h.Service.DenyAccessToken(principal.TokenID, principal.UserID, principal.ExpiresAt)
+}
+
+// resolveAudience validates the audience a client asked for. It writes the
+// error response itself when the audience is not allowed.
+func (h *Handler) resolveAudience(c *gin.Context, requested string) ([]string, bool) {
+	audience, err := h.Service.ResolveAudience(requested)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return audience, true
+}
+
+// resolveScope validates the scope a client asked for against the scopes the
+// user is allowed. It writes the error response itself on failure.
+func (h *Handler) resolveScope(c *gin.Context, userID uuid.UUID, requested string) (string, bool) {
+	scope, err := h.Service.ResolveScope(userID, requested)
+	if err != nil {
+		respondScopeError(c, err)
+		return "", false
+	}
+	return scope, true
+}
+
+func respondScopeError(c *gin.Context, err error) {
+	if errors.Is(err, utils.ErrInvalidScope) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "could not resolve scope"})
+}
+
+// JWKSHandler publishes the public keys access tokens can be verified with.
+func (h *Handler) JWKSHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.Service.Keys.PublishedKeys())
+}
+
+func (h *Handler) ListSigningKeysHandler(c *gin.Context) {
+	keys, err := h.Service.ListSigningKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list signing keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+func (h *Handler) GenerateSigningKeyHandler(c *gin.Context) {
 	var requestBody struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
+		Algorithm string `json:"alg"`
 	}
 
 	if err := c.BindJSON(&requestBody); err != nil {
@@ -145,54 +543,271 @@ func (h *Handler) RefreshTokensHandler(c *gin.Context) {
 		return
 	}
 
-	ipAddress := c.ClientIP()
+	key, err := h.Service.GenerateSigningKey(requestBody.Algorithm)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("signing key %s generated by %s", key.ID, c.GetString(middleware.AdminContextKey))
+	c.JSON(http.StatusCreated, key)
+}
 
-	valid, err := h.Service.ValidateRefreshToken(requestBody.RefreshToken, requestBody.AccessToken, ipAddress)
+func (h *Handler) PromoteSigningKeyHandler(c *gin.Context) {
+	key, err := h.Service.PromoteSigningKey(c.Param("kid"))
 	if err != nil {
-		if err.Error() == "IP address mismatch" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "IP address mismatch"})
+		respondSigningKeyError(c, err)
+		return
+	}
+
+	log.Printf("signing key %s promoted by %s", key.ID, c.GetString(middleware.AdminContextKey))
+	c.JSON(http.StatusOK, key)
+}
+
+func (h *Handler) RetireSigningKeyHandler(c *gin.Context) {
+	var requestBody struct {
+		RetiresAt time.Time `json:"retires_at"`
+	}
+
+	// the body is optional, without it the key retires after the grace period
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&requestBody); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
 			return
 		}
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+	}
+
+	key, err := h.Service.RetireSigningKey(c.Param("kid"), requestBody.RetiresAt)
+	if err != nil {
+		respondSigningKeyError(c, err)
 		return
 	}
 
-	if !valid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token or IP address mismatch"})
+	log.Printf("signing key %s retired by %s", key.ID, c.GetString(middleware.AdminContextKey))
+	c.JSON(http.StatusOK, key)
+}
+
+func (h *Handler) ListRolesHandler(c *gin.Context) {
+	roles, err := h.Service.ListRoles()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list roles"})
 		return
 	}
 
-	userIDStr, err := utils.ExtractUserIDFromToken(requestBody.AccessToken, h.Config.JWTSecretKey)
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+func (h *Handler) SaveRoleHandler(c *gin.Context) {
+	var requestBody struct {
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+
+	if err := c.BindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	role, err := h.Service.SaveRole(c.Param("name"), requestBody.Description, requestBody.Permissions)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid access token"})
+		respondRoleError(c, err)
 		return
 	}
 
-	newAccessToken, err := utils.GenerateAccessToken(userIDStr, ipAddress, h.Config.JWTSecretKey)
+	log.Printf("role %s saved by %s", role.Name, c.GetString(middleware.AdminContextKey))
+	c.JSON(http.StatusOK, role)
+}
+
+func (h *Handler) GetUserHandler(c *gin.Context) {
+	userID, err := utils.ConvertStringToUUID(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not generate access token"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
 		return
 	}
 
-	newRefreshToken, err := utils.GenerateRefreshToken()
+	user, err := h.Service.GetUserByID(userID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not generate refresh token"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
 
-	userID, err := utils.ConvertStringToUUID(userIDStr)
+	roles, err := h.Service.GetUserRoles(userID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error occurred"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load roles"})
 		return
 	}
 
-	if err := h.Service.SaveRefreshToken(userID, newRefreshToken, ipAddress); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save refresh token"})
+	c.JSON(http.StatusOK, gin.H{"user": user, "roles": roles})
+}
+
+func (h *Handler) ListUserRolesHandler(c *gin.Context) {
+	userID, err := utils.ConvertStringToUUID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	roles, err := h.Service.GetUserRoles(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load roles"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+func (h *Handler) AssignRoleHandler(c *gin.Context) {
+	userID, err := utils.ConvertStringToUUID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	var requestBody struct {
+		Role string `json:"role"`
+	}
+
+	if err := c.BindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
 		return
 	}
 
+	actor := c.GetString(middleware.AdminContextKey)
+	if err := h.Service.AssignRole(userID, requestBody.Role, actor); err != nil {
+		respondRoleError(c, err)
+		return
+	}
+
+	h.Service.RecordSecurityEvent(models.SecurityEvent{
+		UserID:    userID,
+		Type:      models.SecurityEventRoleAssigned,
+		Actor:     actor,
+		IPAddress: middleware.ClientIP(c),
+		Details:   "role " + requestBody.Role + " assigned",
+	})
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handler) RemoveRoleHandler(c *gin.Context) {
+	userID, err := utils.ConvertStringToUUID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	role := c.Param("role")
+	if err := h.Service.RemoveRole(userID, role); err != nil {
+		respondRoleError(c, err)
+		return
+	}
+
+	h.Service.RecordSecurityEvent(models.SecurityEvent{
+		UserID:    userID,
+		Type:      models.SecurityEventRoleRemoved,
+		Actor:     c.GetString(middleware.AdminContextKey),
+		IPAddress: middleware.ClientIP(c),
+		Details:   "role " + role + " removed",
+	})
+	c.Status(http.StatusNoContent)
+}
+
+func respondRoleError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrRoleNotFound), errors.Is(err, ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidRoleName):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not update roles"})
+	}
+}
+
+func respondSigningKeyError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrSigningKeyNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrActiveKeyRetire), errors.Is(err, ErrKeyRetired):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not update signing key"})
+	}
+}
+
+func respondPasswordError(c *gin.Context, err error) {
+	var policyErr *utils.PasswordPolicyError
+	switch {
+	case errors.As(err, &policyErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password does not meet the policy", "violations": policyErr.Violations})
+	case errors.Is(err, ErrInvalidResetToken), errors.Is(err, ErrPasswordUnchanged):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrIncorrectPassword):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not update password"})
+	}
+}
+
+func respondRefreshError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrIPAddressMismatch), errors.Is(err, ErrRefreshTokenReused), errors.Is(err, ErrDPoPKeyMismatch):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+	}
+}
+
+func (h *Handler) sessionInfo(c *gin.Context, deviceLabel string) SessionInfo {
+	return SessionInfo{
+		IPAddress:   middleware.ClientIP(c),
+		UserAgent:   c.Request.UserAgent(),
+		DeviceLabel: deviceLabel,
+	}
+}
+
+// issueTokens opens a new session for the user and writes the token pair. It
+// returns nil when it had to respond with an error instead.
+func (h *Handler) issueTokens(c *gin.Context, userID uuid.UUID, info SessionInfo, audience []string) *models.Token {
+	refreshToken, err := utils.GenerateRefreshToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not generate refresh token"})
+		return nil
+	}
+
+	session, err := h.Service.CreateSession(userID, refreshToken, info)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save refresh token"})
+		return nil
+	}
+
+	accessToken, err := h.Service.IssueAccessToken(session, info.IPAddress, audience, session.Scope)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not generate access token"})
+		return nil
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"access_token":  newAccessToken,
-		"refresh_token": newRefreshToken,
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"token_type":    session.TokenType(),
+		"scope":         session.Scope,
 	})
+	return session
+}
+
+// dpopKey verifies the DPoP proof sent to a token endpoint, if any, and
+// returns the thumbprint of its key. It writes the error response itself
+// when the proof is invalid.
+func (h *Handler) dpopKey(c *gin.Context) (string, bool) {
+	jkt, err := middleware.DPoPKey(c, h.Service.DPoPVerifier(), "")
+	if err != nil {
+		if errors.Is(err, utils.ErrInvalidDPoPProof) || errors.Is(err, utils.ErrDPoPProofReused) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return "", false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not verify DPoP proof"})
+		return "", false
+	}
+	return jkt, true
 }
@@ -0,0 +1,319 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"test-task/internal/config"
+	"test-task/internal/modules/auth/models"
+	"test-task/pkg/utils"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultKeyRefreshInterval = time.Minute
+	// unknown kids trigger a reload, but not more often than this
+	minForcedKeyReload = 5 * time.Second
+)
+
+var (
+	ErrSigningKeyNotFound = errors.New("signing key not found")
+	ErrActiveKeyRetire    = errors.New("the active signing key cannot be retired")
+	ErrKeyRetired         = errors.New("signing key is retired")
+)
+
+// KeyStore keeps a key ring in sync with the signing_keys table so every
+// instance picks up generated, promoted and retired keys. The key from the
+// configuration signs until a stored key is first promoted, and retires like
+// any replaced key the grace period after that.
+type KeyStore struct {
+	db         *gorm.DB
+	static     *utils.SigningKey
+	passphrase string
+	interval   time.Duration
+	grace      time.Duration
+
+	mu           sync.Mutex
+	ring         *utils.KeyRing
+	loadedAt     time.Time
+	forcedReload time.Time
+}
+
+func NewKeyStore(db *gorm.DB, static *utils.SigningKey, passphrase string, interval, grace time.Duration) (*KeyStore, error) {
+	if interval <= 0 {
+		interval = defaultKeyRefreshInterval
+	}
+
+	store := &KeyStore{
+		db:         db,
+		static:     static,
+		passphrase: passphrase,
+		interval:   interval,
+		grace:      grace,
+	}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload rebuilds the key ring from the database.
+func (k *KeyStore) Reload() error {
+	var stored []models.SigningKey
+	if err := k.db.Where("retires_at IS NULL OR retires_at > NOW()").Find(&stored).Error; err != nil {
+		return err
+	}
+
+	var firstActivation sql.NullTime
+	if err := k.db.Model(&models.SigningKey{}).Select("MIN(activated_at)").Row().Scan(&firstActivation); err != nil {
+		return err
+	}
+
+	ring := utils.NewKeyRing()
+	var staticRetiresAt time.Time
+	if firstActivation.Valid {
+		staticRetiresAt = firstActivation.Time.Add(k.grace)
+	}
+	if staticRetiresAt.IsZero() || time.Now().Before(staticRetiresAt) {
+		ring.Add(k.static, staticRetiresAt)
+		if err := ring.Activate(k.static.ID); err != nil {
+			return err
+		}
+	}
+
+	for _, record := range stored {
+		key, err := k.decode(record)
+		if err != nil {
+			log.Printf("skipping signing key %s: %v", record.ID, err)
+			continue
+		}
+
+		var retiresAt time.Time
+		if record.RetiresAt != nil {
+			retiresAt = *record.RetiresAt
+		}
+		ring.Add(key, retiresAt)
+
+		if record.Status == models.KeyStatusActive {
+			if err := ring.Activate(key.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	k.mu.Lock()
+	k.ring = ring
+	k.loadedAt = time.Now()
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *KeyStore) current() *utils.KeyRing {
+	k.mu.Lock()
+	stale := time.Since(k.loadedAt) > k.interval
+	k.mu.Unlock()
+
+	if stale {
+		if err := k.Reload(); err != nil {
+			log.Printf("failed to reload signing keys: %v", err)
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.ring
+}
+
+func (k *KeyStore) SigningKey() (*utils.SigningKey, error) {
+	return k.current().SigningKey()
+}
+
+// VerificationKey resolves a kid, reloading early when another instance
+// already signs with a key this one has not seen yet.
+func (k *KeyStore) VerificationKey(kid string) (*utils.SigningKey, error) {
+	key, err := k.current().VerificationKey(kid)
+	if !errors.Is(err, utils.ErrUnknownKey) || kid == "" {
+		return key, err
+	}
+
+	k.mu.Lock()
+	allowed := time.Since(k.forcedReload) > minForcedKeyReload
+	if allowed {
+		k.forcedReload = time.Now()
+	}
+	k.mu.Unlock()
+
+	if !allowed {
+		return nil, err
+	}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k.current().VerificationKey(kid)
+}
+
+func (k *KeyStore) PublishedKeys() utils.JWKS {
+	return k.current().PublishedKeys()
+}
+
+func (k *KeyStore) encode(privateKey crypto.Signer) (string, bool, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return "", false, err
+	}
+
+	block := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if k.passphrase == "" {
+		return string(block), false, nil
+	}
+
+	sealed, err := utils.EncryptSecret(k.passphrase, block)
+	return sealed, true, err
+}
+
+func (k *KeyStore) decode(record models.SigningKey) (*utils.SigningKey, error) {
+	data := []byte(record.PrivateKey)
+	if record.Encrypted {
+		if k.passphrase == "" {
+			return nil, errors.New("key is encrypted but no key encryption key is configured")
+		}
+
+		var err error
+		if data, err = utils.DecryptSecret(k.passphrase, record.PrivateKey); err != nil {
+			return nil, fmt.Errorf("error decrypting key: %w", err)
+		}
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM data")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+
+	return utils.NewSigningKey(record.Algorithm, record.ID, signer)
+}
+
+func (s *Service) keyRetirementGrace() time.Duration {
+	return keyRetirementGrace(s.Config)
+}
+
+func keyRetirementGrace(cfg *config.Config) time.Duration {
+	// outstanding access tokens must be able to run out before their key goes
+	if cfg.JWTKeyRetirementGrace < utils.AccessTokenTTL {
+		return utils.AccessTokenTTL
+	}
+	return cfg.JWTKeyRetirementGrace
+}
+
+func (s *Service) ListSigningKeys() ([]models.SigningKey, error) {
+	var keys []models.SigningKey
+	err := s.Handler.DB.Order("created_at DESC").Find(&keys).Error
+	return keys, err
+}
+
+// GenerateSigningKey creates a pending key. It is published right away but
+// only signs once promoted.
+func (s *Service) GenerateSigningKey(alg string) (*models.SigningKey, error) {
+	privateKey, err := utils.GeneratePrivateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := utils.NewSigningKey(alg, "", privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, encrypted, err := s.Keys.encode(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &models.SigningKey{
+		ID:         key.ID,
+		Algorithm:  alg,
+		PrivateKey: encoded,
+		Encrypted:  encrypted,
+		Status:     models.KeyStatusPending,
+		CreatedAt:  time.Now(),
+	}
+	if err := s.Handler.DB.Create(record).Error; err != nil {
+		return nil, err
+	}
+
+	return record, s.Keys.Reload()
+}
+
+// PromoteSigningKey makes kid the signing key. The previously active key keeps
+// verifying for the retirement grace period.
+func (s *Service) PromoteSigningKey(kid string) (*models.SigningKey, error) {
+	now := time.Now()
+	retiresAt := now.Add(s.keyRetirementGrace())
+
+	var record models.SigningKey
+	err := s.Handler.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ?", kid).First(&record).Error; err != nil {
+			return ErrSigningKeyNotFound
+		}
+		if record.RetiresAt != nil && now.After(*record.RetiresAt) {
+			return ErrKeyRetired
+		}
+
+		err := tx.Model(&models.SigningKey{}).
+			Where("status = ? AND id <> ?", models.KeyStatusActive, kid).
+			Updates(map[string]interface{}{"status": models.KeyStatusRetiring, "retires_at": retiresAt}).Error
+		if err != nil {
+			return err
+		}
+
+		record.Status = models.KeyStatusActive
+		record.ActivatedAt = &now
+		record.RetiresAt = nil
+		return tx.Save(&record).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, s.Keys.Reload()
+}
+
+// RetireSigningKey stops a key from verifying after retiresAt. A zero time
+// means after the retirement grace period.
+func (s *Service) RetireSigningKey(kid string, retiresAt time.Time) (*models.SigningKey, error) {
+	if retiresAt.IsZero() {
+		retiresAt = time.Now().Add(s.keyRetirementGrace())
+	}
+
+	var record models.SigningKey
+	if err := s.Handler.DB.Where("id = ?", kid).First(&record).Error; err != nil {
+		return nil, ErrSigningKeyNotFound
+	}
+	if record.Status == models.KeyStatusActive {
+		return nil, ErrActiveKeyRetire
+	}
+
+	record.Status = models.KeyStatusRetiring
+	record.RetiresAt = &retiresAt
+	if err := s.Handler.DB.Save(&record).Error; err != nil {
+		return nil, err
+	}
+
+	return &record, s.Keys.Reload()
+}
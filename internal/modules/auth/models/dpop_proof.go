@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// DPoPProof remembers a DPoP proof that was accepted, so the same proof
+// cannot be replayed while its iat is still within the accepted window. ID
+// hashes the key thumbprint together with the proof's jti.
+type DPoPProof struct {
+	ID        string    `gorm:"primaryKey;size:64" json:"id"`
+	ExpiresAt time.Time `gorm:"index" json:"expires_at"`
+}
+
+func (DPoPProof) TableName() string {
+	return "dpop_proofs"
+}
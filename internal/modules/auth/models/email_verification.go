@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EmailVerification records a verification email. ID is the jti of the
+// signed token it carried; UsedAt makes that token single use.
+type EmailVerification struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;index" json:"user_id"`
+	Email     string     `gorm:"size:255" json:"email"`
+	CreatedAt time.Time  `gorm:"index" json:"created_at"`
+	ExpiresAt time.Time  `gorm:"index" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PasswordReset is a password reset token that was emailed to a user. Only
+// its hash is stored; UsedAt makes it single use.
+type PasswordReset struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;index" json:"user_id"`
+	TokenHash string     `gorm:"uniqueIndex;size:64" json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `gorm:"index" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RevokedAccessToken denylists an access token by its jti until it expires on
+// its own.
+type RevokedAccessToken struct {
+	JTI       string    `gorm:"primaryKey;size:64" json:"jti"`
+	UserID    uuid.UUID `gorm:"type:uuid;index" json:"user_id"`
+	ExpiresAt time.Time `gorm:"index" json:"expires_at"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
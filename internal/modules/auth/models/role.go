@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Built-in permissions, granted to the admin role on startup.
+const (
+	PermissionUsersRead             = "users:read"
+	PermissionRolesManage           = "roles:manage"
+	PermissionTokensIssue           = "tokens:issue"
+	PermissionKeysManage            = "keys:manage"
+	PermissionClientsManage         = "clients:manage"
+	PermissionServiceAccountsManage = "service_accounts:manage"
+
+	RoleAdmin = "admin"
+)
+
+var BuiltinPermissions = []string{
+	PermissionUsersRead,
+	PermissionRolesManage,
+	PermissionTokensIssue,
+	PermissionKeysManage,
+	PermissionClientsManage,
+	PermissionServiceAccountsManage,
+}
+
+type Role struct {
+	ID          uuid.UUID    `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	Name        string       `gorm:"uniqueIndex;size:64" json:"name"`
+	Description string       `gorm:"size:255" json:"description"`
+	Permissions []Permission `gorm:"many2many:role_permissions;" json:"permissions"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+type Permission struct {
+	ID          uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	Name        string    `gorm:"uniqueIndex;size:64" json:"name"`
+	Description string    `gorm:"size:255" json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// UserRole assigns a role to a user. AssignedBy names the admin credential or
+// user that made the assignment.
+type UserRole struct {
+	UserID     uuid.UUID `gorm:"type:uuid;primaryKey" json:"user_id"`
+	RoleID     uuid.UUID `gorm:"type:uuid;primaryKey" json:"role_id"`
+	AssignedBy string    `gorm:"size:100" json:"assigned_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
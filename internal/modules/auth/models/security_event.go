@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	SecurityEventRefreshTokenReuse      = "refresh_token_reuse"
+	SecurityEventTokensIssued           = "tokens_issued"
+	SecurityEventRoleAssigned           = "role_assigned"
+	SecurityEventRoleRemoved            = "role_removed"
+	SecurityEventAuthorizationCodeReuse = "authorization_code_reuse"
+	SecurityEventIPAddressChanged       = "ip_address_changed"
+	SecurityEventEmailVerified          = "email_verified"
+	SecurityEventPasswordReset          = "password_reset"
+	SecurityEventPasswordChanged        = "password_changed"
+)
+
+// SecurityEvent is an audit record of something security relevant that
+// happened to an account. Actor names who caused the event when it was not
+// the user themselves.
+type SecurityEvent struct {
+	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	UserID    uuid.UUID `gorm:"type:uuid;index" json:"user_id"`
+	Type      string    `gorm:"size:64;index" json:"type"`
+	Actor     string    `gorm:"size:100" json:"actor,omitempty"`
+	IPAddress string    `gorm:"size:45" json:"ip_address"`
+	Details   string    `gorm:"type:text" json:"details"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session is the user-facing view of a token family. It is what clients get
+// back from the sessions API and deliberately carries no token material.
+type Session struct {
+	ID          uuid.UUID `json:"id"`
+	DeviceLabel string    `json:"device_label"`
+	UserAgent   string    `json:"user_agent"`
+	IPAddress   string    `json:"ip_address"`
+	// LastIPAddress and IPBindingDecision describe the latest refresh
+	LastIPAddress     string    `json:"last_ip_address,omitempty"`
+	IPBindingDecision string    `json:"ip_binding_decision,omitempty"`
+	Scope             string    `json:"scope"`
+	CreatedAt         time.Time `json:"created_at"`
+	LastUsedAt        time.Time `json:"last_used_at"`
+	ExpiresAt         time.Time `json:"expires_at"`
+	Current           bool      `json:"current"`
+}
+
+// TokenType is the token_type of the access tokens the session issues.
+func (t *Token) TokenType() string {
+	if t.JKT != "" {
+		return "DPoP"
+	}
+	return "Bearer"
+}
+
+// ToSession describes the session t is the latest refresh token of.
+func (t *Token) ToSession(currentSessionID uuid.UUID) Session {
+	return Session{
+		ID:                t.FamilyID,
+		DeviceLabel:       t.DeviceLabel,
+		UserAgent:         t.UserAgent,
+		IPAddress:         t.IPAddress,
+		LastIPAddress:     t.LastIPAddress,
+		IPBindingDecision: t.IPBindingDecision,
+		Scope:             t.Scope,
+		CreatedAt:         t.AuthenticatedAt,
+		LastUsedAt:        t.LastUsedAt,
+		ExpiresAt:         t.ExpiresAt,
+		Current:           t.FamilyID == currentSessionID,
+	}
+}
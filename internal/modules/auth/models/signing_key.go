@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+const (
+	// KeyStatusPending keys are published and verify tokens but do not sign
+	// yet, so verifiers can pick them up before the switch
+	KeyStatusPending  = "pending"
+	KeyStatusActive   = "active"
+	KeyStatusRetiring = "retiring"
+)
+
+// SigningKey is a stored access token signing key. The private key is a PKCS#8
+// PEM block, sealed with the key encryption key when one is configured.
+type SigningKey struct {
+	ID          string     `gorm:"primaryKey;size:64" json:"kid"`
+	Algorithm   string     `gorm:"size:16" json:"alg"`
+	PrivateKey  string     `gorm:"type:text" json:"-"`
+	Encrypted   bool       `json:"-"`
+	Status      string     `gorm:"size:16;index" json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ActivatedAt *time.Time `json:"activated_at,omitempty"`
+	RetiresAt   *time.Time `json:"retires_at,omitempty"`
+}
@@ -6,11 +6,38 @@ import (
 	"github.com/google/uuid"
 )
 
+// Token is a single refresh token. Rotating a refresh token consumes it and
+// issues a child in the same family, so a family represents one signed-in
+// session and its whole lineage of refresh tokens.
 type Token struct {
-	ID               uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
-	UserID           uuid.UUID `gorm:"type:uuid" json:"user_id"`
-	RefreshTokenHash string    `gorm:"size:255" json:"-"`
-	IPAddress        string    `gorm:"size:45" json:"ip_address"`
-	CreatedAt        time.Time `json:"created_at"`
-	ExpiresAt        time.Time `json:"expires_at"`
+	ID               uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	UserID           uuid.UUID  `gorm:"type:uuid;index" json:"user_id"`
+	FamilyID         uuid.UUID  `gorm:"type:uuid;index" json:"family_id"`
+	ParentID         *uuid.UUID `gorm:"type:uuid" json:"parent_id,omitempty"`
+	RefreshTokenHash string     `gorm:"size:255;uniqueIndex" json:"-"`
+	IPAddress        string     `gorm:"size:45" json:"ip_address"`
+	UserAgent        string     `gorm:"size:512" json:"user_agent"`
+	DeviceLabel      string     `gorm:"size:100" json:"device_label"`
+	ClientID         string     `gorm:"size:64;index" json:"client_id,omitempty"`
+	AuthenticatedAt  time.Time  `json:"authenticated_at"`
+	CreatedAt        time.Time  `json:"created_at"`
+	LastUsedAt       time.Time  `json:"last_used_at"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	UsedAt           *time.Time `json:"used_at,omitempty"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+
+	// Restrictions of tokens issued on the user's behalf, carried over to
+	// every rotation so refreshing cannot widen them.
+	Scope          string        `gorm:"size:1024" json:"scope,omitempty"`
+	AccessTokenTTL time.Duration `json:"-"`
+	MaxExpiresAt   *time.Time    `json:"max_expires_at,omitempty"`
+	// JKT is the thumbprint of the DPoP key the session is bound to. Bound
+	// sessions only refresh with a proof signed by that key.
+	JKT string `gorm:"size:64" json:"jkt,omitempty"`
+
+	// LastIPAddress is the address the session was last refreshed from and
+	// IPBindingDecision what the IP binding policy made of it. IPAddress
+	// stays the address the session was opened from.
+	LastIPAddress     string `gorm:"size:45" json:"last_ip_address,omitempty"`
+	IPBindingDecision string `gorm:"size:16" json:"ip_binding_decision,omitempty"`
 }
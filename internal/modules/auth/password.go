@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"test-task/internal/config"
+	"test-task/internal/modules/auth/models"
+	"test-task/pkg/utils"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPasswordResetTTL = 30 * time.Minute
+	// passwordResetInterval is the least time between two reset emails to
+	// one account
+	passwordResetInterval = time.Minute
+)
+
+var (
+	ErrInvalidResetToken    = errors.New("invalid or expired reset token")
+	ErrIncorrectPassword    = errors.New("current password is incorrect")
+	ErrPasswordUnchanged    = errors.New("new password must differ from the current one")
+	ErrPasswordChangeDenied = errors.New("passwords can only be changed by the user themselves")
+)
+
+// PasswordPolicy is the configured password policy.
+func (s *Service) PasswordPolicy() utils.PasswordPolicy {
+	policy := utils.PasswordPolicy{
+		MinLength:       s.Config.PasswordMinLength,
+		MaxLength:       s.Config.PasswordMaxLength,
+		RequiredClasses: s.Config.PasswordRequiredClasses,
+		BannedWords:     s.Config.PasswordBannedWords,
+		MinStrength:     s.Config.PasswordMinStrength,
+	}
+	if s.Config.PasswordBreachedCorpusDir != "" {
+		policy.Breached = utils.BreachedPasswordCorpus{
+			Dir:      s.Config.PasswordBreachedCorpusDir,
+			MinCount: s.Config.PasswordBreachedMinCount,
+		}
+	}
+	return policy
+}
+
+// ValidatePassword checks a password a user wants to set against the policy.
+// Parts of their email address must not make it up.
+func (s *Service) ValidatePassword(email, password string) error {
+	return s.PasswordPolicy().Check(password, email)
+}
+
+func validatePasswordConfig(cfg *config.Config) error {
+	if err := utils.ValidateCharacterClasses(cfg.PasswordRequiredClasses); err != nil {
+		return err
+	}
+	if cfg.PasswordMinStrength < 0 || cfg.PasswordMinStrength > 4 {
+		return fmt.Errorf("PASSWORD_MIN_STRENGTH must be between 0 and 4")
+	}
+	if cfg.PasswordMaxLength > utils.BcryptMaxPasswordBytes {
+		return fmt.Errorf("PASSWORD_MAX_LENGTH must not exceed %d bytes, bcrypt ignores the rest", utils.BcryptMaxPasswordBytes)
+	}
+	if cfg.PasswordBreachedCorpusDir != "" {
+		if info, err := os.Stat(cfg.PasswordBreachedCorpusDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("PASSWORD_BREACHED_CORPUS_DIR %q is not a directory", cfg.PasswordBreachedCorpusDir)
+		}
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashedPassword), nil
+}
+
+// RequestPasswordReset emails a short lived, single use reset link to the
+// account with this address. Unknown addresses are ignored without an error,
+// and so are requests made within a minute of the last one.
+func (s *Service) RequestPasswordReset(email string) error {
+	var user models.User
+	if err := s.Handler.DB.Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	now := time.Now()
+	var recent int64
+	if err := s.Handler.DB.Model(&models.PasswordReset{}).
+		Where("user_id = ? AND created_at > ?", user.ID, now.Add(-passwordResetInterval)).
+		Count(&recent).Error; err != nil {
+		return err
+	}
+	if recent > 0 {
+		return nil
+	}
+
+	ttl := s.Config.PasswordResetTTL
+	if ttl <= 0 {
+		ttl = defaultPasswordResetTTL
+	}
+
+	token, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	reset := &models.PasswordReset{
+		ID:        uuid.New(),
+		UserID:    user.ID,
+		TokenHash: utils.HashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := s.Handler.DB.Create(reset).Error; err != nil {
+		return err
+	}
+
+	link := token
+	if s.Config.PasswordResetURL != "" {
+		link = s.Config.PasswordResetURL + "?token=" + url.QueryEscape(token)
+	}
+	body := fmt.Sprintf("Someone asked to reset the password of your account. Use the link below to choose a new one. "+
+		"It expires in %s and can be used once.\n\n%s\n\nIf it was not you, you can ignore this email; your password stays unchanged.", ttl, link)
+	return s.Mailer.Send(user.Email, "Reset your password", body)
+}
+
+// ResetPassword consumes a reset token and sets the user's new password.
+// Every session of the user is revoked, including browser sign-ins at the
+// authorization endpoint, along with the other reset tokens they were sent.
+func (s *Service) ResetPassword(token, password, ipAddress string) error {
+	var reset models.PasswordReset
+	if err := s.Handler.DB.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", utils.HashToken(token), time.Now()).
+		First(&reset).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidResetToken
+		}
+		return err
+	}
+	user, err := s.GetUserByID(reset.UserID)
+	if err != nil {
+		return ErrInvalidResetToken
+	}
+
+	if err := s.ValidatePassword(user.Email, password); err != nil {
+		return err
+	}
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	err = s.Handler.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		// the guard on used_at makes a token that is presented twice at once
+		// succeed only once
+		consumed := tx.Model(&models.PasswordReset{}).
+			Where("user_id = ? AND used_at IS NULL AND expires_at > ?", reset.UserID, now).
+			Update("used_at", now)
+		if consumed.Error != nil {
+			return consumed.Error
+		}
+		if consumed.RowsAffected == 0 {
+			return ErrInvalidResetToken
+		}
+
+		updated := tx.Model(&models.User{}).Where("id = ?", reset.UserID).Updates(map[string]interface{}{
+			"password_hash": hashedPassword,
+			"updated_at":    now,
+		})
+		if updated.Error != nil {
+			return updated.Error
+		}
+		if updated.RowsAffected == 0 {
+			return ErrInvalidResetToken
+		}
+
+		if err := endLoginSessions(tx, reset.UserID); err != nil {
+			return err
+		}
+		return revokeUserSessions(tx, reset.UserID, uuid.Nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.RecordSecurityEvent(models.SecurityEvent{
+		UserID:    reset.UserID,
+		Type:      models.SecurityEventPasswordReset,
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("password reset with token %s, all sessions revoked", reset.ID),
+	})
+	return nil
+}
+
+// endLoginSessions signs the user out of the authorization endpoint, so the
+// browser has to enter the new password before approving clients again. The
+// table belongs to the oauth module, which builds on this one.
+func endLoginSessions(tx *gorm.DB, userID uuid.UUID) error {
+	return tx.Exec("DELETE FROM login_sessions WHERE user_id = ?", userID).Error
+}
+
+// ChangePassword sets a new password for a user who proved they know the
+// current one, and notifies them by email. With signOutOthers every session
+// but keepSession is revoked, and browser sign-ins at the authorization
+// endpoint end.
+func (s *Service) ChangePassword(userID uuid.UUID, currentPassword, newPassword string, signOutOthers bool, keepSession uuid.UUID, ipAddress string) error {
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return ErrUserNotFound
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(currentPassword)); err != nil {
+		return ErrIncorrectPassword
+	}
+	if newPassword == currentPassword {
+		return ErrPasswordUnchanged
+	}
+	if err := s.ValidatePassword(user.Email, newPassword); err != nil {
+		return err
+	}
+	hashedPassword, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	err = s.Handler.DB.Transaction(func(tx *gorm.DB) error {
+		// the hash must still be the one the current password was checked
+		// against, otherwise a concurrent change would be overwritten
+		updated := tx.Model(&models.User{}).
+			Where("id = ? AND password_hash = ?", user.ID, user.PasswordHash).
+			Updates(map[string]interface{}{
+				"password_hash": hashedPassword,
+				"updated_at":    time.Now(),
+			})
+		if updated.Error != nil {
+			return updated.Error
+		}
+		if updated.RowsAffected == 0 {
+			return ErrIncorrectPassword
+		}
+
+		if signOutOthers {
+			if err := endLoginSessions(tx, user.ID); err != nil {
+				return err
+			}
+			return revokeUserSessions(tx, user.ID, keepSession)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	details := "password changed, other sessions kept"
+	if signOutOthers {
+		details = "password changed, other sessions revoked"
+	}
+	s.RecordSecurityEvent(models.SecurityEvent{
+		UserID:    user.ID,
+		Type:      models.SecurityEventPasswordChanged,
+		IPAddress: ipAddress,
+		Details:   details,
+	})
+
+	body := fmt.Sprintf("The password of your account was changed at %s from %s.\n\n"+
+		"If it was not you, reset your password right away and contact support.", time.Now().UTC().Format(time.RFC1123), ipAddress)
+	if err := s.Mailer.Send(user.Email, "Your password was changed", body); err != nil {
+		log.Printf("failed to send password change notification to user %s: %v", user.ID, err)
+	}
+	return nil
+}
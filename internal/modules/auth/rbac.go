@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"errors"
+	"test-task/internal/modules/auth/models"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrRoleNotFound    = errors.New("role not found")
+	ErrInvalidRoleName = errors.New("role name is required")
+)
+
+// seedAuthorization makes sure the built-in permissions exist and the admin
+// role holds all of them.
+func (s *Service) seedAuthorization() error {
+	_, err := s.SaveRole(models.RoleAdmin, "Full administrative access", models.BuiltinPermissions)
+	return err
+}
+
+func (s *Service) ListRoles() ([]models.Role, error) {
+	var roles []models.Role
+	err := s.Handler.DB.Preload("Permissions").Order("name").Find(&roles).Error
+	return roles, err
+}
+
+// SaveRole creates the role or replaces the permissions of an existing one.
+// Unknown permissions are created on the fly.
+func (s *Service) SaveRole(name, description string, permissionNames []string) (*models.Role, error) {
+	if name == "" {
+		return nil, ErrInvalidRoleName
+	}
+
+	var role models.Role
+	err := s.Handler.DB.Transaction(func(tx *gorm.DB) error {
+		permissions := make([]models.Permission, 0, len(permissionNames))
+		for _, permissionName := range permissionNames {
+			permission := models.Permission{Name: permissionName}
+			err := tx.Where("name = ?", permissionName).
+				Attrs(models.Permission{ID: uuid.New(), CreatedAt: time.Now()}).
+				FirstOrCreate(&permission).Error
+			if err != nil {
+				return err
+			}
+			permissions = append(permissions, permission)
+		}
+
+		err := tx.Where("name = ?", name).
+			Attrs(models.Role{ID: uuid.New(), CreatedAt: time.Now()}).
+			FirstOrCreate(&role).Error
+		if err != nil {
+			return err
+		}
+
+		if description != "" {
+			role.Description = description
+		}
+		role.UpdatedAt = time.Now()
+		if err := tx.Save(&role).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&role).Association("Permissions").Replace(permissions)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+// PermissionNames lists every permission known to the service.
+func (s *Service) PermissionNames() ([]string, error) {
+	var names []string
+	err := s.Handler.DB.Model(&models.Permission{}).Order("name").Pluck("name", &names).Error
+	return names, err
+}
+
+func (s *Service) GetUserRoles(userID uuid.UUID) ([]models.Role, error) {
+	var roles []models.Role
+	err := s.Handler.DB.Preload("Permissions").
+		Joins("JOIN user_roles ON user_roles.role_id = roles.id").
+		Where("user_roles.user_id = ?", userID).
+		Order("roles.name").
+		Find(&roles).Error
+	return roles, err
+}
+
+func (s *Service) AssignRole(userID uuid.UUID, roleName, assignedBy string) error {
+	if _, err := s.GetUserByID(userID); err != nil {
+		return ErrUserNotFound
+	}
+
+	var role models.Role
+	if err := s.Handler.DB.Where("name = ?", roleName).First(&role).Error; err != nil {
+		return ErrRoleNotFound
+	}
+
+	assignment := &models.UserRole{
+		UserID:     userID,
+		RoleID:     role.ID,
+		AssignedBy: assignedBy,
+		CreatedAt:  time.Now(),
+	}
+	return s.Handler.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(assignment).Error
+}
+
+func (s *Service) RemoveRole(userID uuid.UUID, roleName string) error {
+	var role models.Role
+	if err := s.Handler.DB.Where("name = ?", roleName).First(&role).Error; err != nil {
+		return ErrRoleNotFound
+	}
+
+	return s.Handler.DB.
+		Where("user_id = ? AND role_id = ?", userID, role.ID).
+		Delete(&models.UserRole{}).Error
+}
+
+// UserAuthorization returns the role and permission names embedded in the
+// user's access tokens.
+func (s *Service) UserAuthorization(userID uuid.UUID) ([]string, []string, error) {
+	var roles []string
+	err := s.Handler.DB.Model(&models.Role{}).
+		Joins("JOIN user_roles ON user_roles.role_id = roles.id").
+		Where("user_roles.user_id = ?", userID).
+		Order("roles.name").
+		Pluck("roles.name", &roles).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var permissions []string
+	err = s.Handler.DB.Model(&models.Permission{}).
+		Joins("JOIN role_permissions ON role_permissions.permission_id = permissions.id").
+		Joins("JOIN user_roles ON user_roles.role_id = role_permissions.role_id").
+		Where("user_roles.user_id = ?", userID).
+		Distinct().
+		Order("permissions.name").
+		Pluck("permissions.name", &permissions).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return roles, permissions, nil
+}
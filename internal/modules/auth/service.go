@@ -1,7 +1,9 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"test-task/internal/config"
 	db "test-task/internal/database"
 	"test-task/internal/modules/auth/models"
@@ -10,22 +12,185 @@ import (
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Service struct {
 	Handler db.DBHandler
 	Config  *config.Config
+	Keys    *KeyStore
+	Mailer  utils.Mailer
 }
 
 func InitAuthService(handler db.DBHandler, cfg *config.Config) (*Service, error) {
-	return &Service{
+	key, err := utils.LoadSigningKey(cfg.JWTSigningAlg, cfg.JWTKeyID, cfg.JWTPrivateKeyFile, cfg.JWTSecretKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading signing key: %w", err)
+	}
+
+	if _, err := utils.ParseIPBindingMode(cfg.IPBindingMode); err != nil {
+		return nil, err
+	}
+	if _, err := utils.ParseEmailVerificationMode(cfg.EmailVerification); err != nil {
+		return nil, err
+	}
+	if err := validatePasswordConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	keys, err := NewKeyStore(handler.DB, key, cfg.JWTKeyEncryptionKey, cfg.JWTKeyRefreshInterval, keyRetirementGrace(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("error loading signing keys: %w", err)
+	}
+
+	service := &Service{
 		Handler: handler,
 		Config:  cfg,
-	}, nil
+		Keys:    keys,
+		Mailer:  newMailer(cfg),
+	}
+	if err := service.seedAuthorization(); err != nil {
+		return nil, fmt.Errorf("error seeding roles: %w", err)
+	}
+
+	return service, nil
+}
+
+// Verifier checks access tokens against the current keys, the configured
+// issuer and audiences, and the denylist.
+func (s *Service) Verifier() utils.TokenVerifier {
+	return utils.TokenVerifier{
+		Keys:      s.Keys,
+		Denylist:  s,
+		Issuer:    s.Config.JWTIssuer,
+		Audiences: s.Config.JWTAudiences,
+		Leeway:    s.Config.JWTLeeway,
+	}
+}
+
+// DPoPVerifier checks DPoP proofs, remembering accepted ones so they cannot
+// be replayed.
+func (s *Service) DPoPVerifier() utils.DPoPVerifier {
+	return utils.DPoPVerifier{
+		ReplayCache: s,
+		BaseURL:     s.Config.PublicURL,
+		Lifetime:    s.Config.DPoPProofLifetime,
+	}
+}
+
+// IPBindingPolicy is the configured IP binding policy. OAuth clients may
+// override its mode.
+func (s *Service) IPBindingPolicy() utils.IPBindingPolicy {
+	mode, err := utils.ParseIPBindingMode(s.Config.IPBindingMode)
+	if err != nil {
+		mode = utils.IPBindingStrict
+	}
+	return utils.IPBindingPolicy{
+		Mode:       mode,
+		IPv4Prefix: s.Config.IPBindingIPv4Prefix,
+		IPv6Prefix: s.Config.IPBindingIPv6Prefix,
+	}
+}
+
+// ResolveAudience picks the audience of a new access token: the requested one
+// when it is allowed, otherwise the first configured audience.
+func (s *Service) ResolveAudience(requested string) ([]string, error) {
+	if requested == "" {
+		if len(s.Config.JWTAudiences) == 0 {
+			return nil, nil
+		}
+		return s.Config.JWTAudiences[:1], nil
+	}
+
+	for _, audience := range s.Config.JWTAudiences {
+		if audience == requested {
+			return []string{requested}, nil
+		}
+	}
+	return nil, ErrAudienceNotAllowed
+}
+
+// AllowedScopes lists the scopes a user may request: the configured user
+// scopes plus the permissions granted by their roles. In limited email
+// verification mode unverified users only get the unverified user scopes.
+func (s *Service) AllowedScopes(userID uuid.UUID) ([]string, error) {
+	if s.EmailVerificationMode() == utils.EmailVerificationLimited {
+		user, err := s.GetUserByID(userID)
+		if err != nil {
+			return nil, err
+		}
+		if user.EmailVerifiedAt == nil {
+			return s.unverifiedScopes(), nil
+		}
+	}
+
+	_, permissions, err := s.UserAuthorization(userID)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]string(nil), s.Config.UserScopes...), permissions...), nil
+}
+
+// ResolveScope narrows the scope of a new session to the requested one, which
+// must be a subset of the scopes the user is allowed.
+func (s *Service) ResolveScope(userID uuid.UUID, requested string) (string, error) {
+	allowed, err := s.AllowedScopes(userID)
+	if err != nil {
+		return "", err
+	}
+	return utils.NarrowScope(requested, allowed)
+}
+
+// SessionScope narrows the scope of an access token minted from an existing
+// session. Sessions keep the scope they were granted, so a refresh can ask
+// for less but never for more.
+func (s *Service) SessionScope(session *models.Token, requested string) (string, error) {
+	if session.Scope == "" {
+		// sessions opened before scopes existed
+		return s.ResolveScope(session.UserID, requested)
+	}
+	return utils.NarrowScope(requested, utils.ParseScope(session.Scope))
+}
+
+// IssueAccessToken signs the access token that accompanies a refresh token.
+// Only the permissions the scope covers are embedded, so a narrowly scoped
+// token cannot reach admin endpoints even when its user could.
+func (s *Service) IssueAccessToken(token *models.Token, ipAddress string, audience []string, scope string) (string, error) {
+	roles, granted, err := s.UserAuthorization(token.UserID)
+	if err != nil {
+		return "", err
+	}
+
+	scopes := utils.ParseScope(scope)
+	var permissions []string
+	for _, permission := range granted {
+		if utils.ContainsScope(scopes, permission) {
+			permissions = append(permissions, permission)
+		}
+	}
+
+	return utils.GenerateAccessToken(utils.AccessTokenParams{
+		UserID:      token.UserID.String(),
+		SessionID:   token.FamilyID.String(),
+		ClientID:    token.ClientID,
+		TokenID:     token.ID.String(),
+		IPAddress:   ipAddress,
+		Scope:       scope,
+		Roles:       roles,
+		Permissions: permissions,
+		JKT:         token.JKT,
+		TTL:         token.AccessTokenTTL,
+		Issuer:      s.Config.JWTIssuer,
+		Audience:    audience,
+	}, s.Keys)
 }
 
 func (s *Service) CreateUser(email, password string) (*models.User, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err := s.ValidatePassword(email, password); err != nil {
+		return nil, err
+	}
+	hashedPassword, err := hashPassword(password)
 	if err != nil {
 		return nil, err
 	}
@@ -33,7 +198,7 @@ func (s *Service) CreateUser(email, password string) (*models.User, error) {
 	user := &models.User{
 		ID:           uuid.New(),
 		Email:        email,
-		PasswordHash: string(hashedPassword),
+		PasswordHash: hashedPassword,
 		CreatedAt:    time.Now(),
 		UpdatedAt:    time.Now(),
 	}
@@ -55,65 +220,463 @@ func (s *Service) AuthenticateUser(email, password string) (uuid.UUID, error) {
 		return uuid.Nil, err
 	}
 
+	// only checked once the password matched, so the answer does not tell
+	// strangers whether an address is registered
+	if err := s.checkEmailVerified(&user); err != nil {
+		return uuid.Nil, err
+	}
+
 	return user.ID, nil
 }
 
-func (s *Service) SaveRefreshToken(userID uuid.UUID, refreshToken, ipAddress string) error {
-	if err := s.Handler.DB.Where("user_id = ?", userID).Delete(&models.Token{}).Error; err != nil {
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+	ErrIPAddressMismatch   = errors.New("IP address mismatch")
+	ErrDPoPKeyMismatch     = errors.New("DPoP proof is not signed with the key the session is bound to")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrAudienceNotAllowed  = errors.New("audience not allowed")
+	ErrUserNotFound        = errors.New("user not found")
+)
+
+// SessionInfo describes the client a session was opened from and, for
+// tokens issued on a user's behalf, how far they are restricted.
+type SessionInfo struct {
+	IPAddress   string
+	UserAgent   string
+	DeviceLabel string
+	// ClientID is set for sessions opened through an OAuth client, and
+	// AuthenticatedAt when the user signed in before the session was opened
+	ClientID        string
+	AuthenticatedAt time.Time
+
+	Scope           string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// JKT binds the session to a DPoP key
+	JKT string
+}
+
+// CreateSession starts a new token family for the user. Other sessions are
+// kept; once the user exceeds MaxSessionsPerUser the least recently used ones
+// are revoked.
+func (s *Service) CreateSession(userID uuid.UUID, refreshToken string, info SessionInfo) (*models.Token, error) {
+	now := time.Now()
+	expiresAt := now.Add(refreshTokenTTL)
+
+	var maxExpiresAt *time.Time
+	if info.RefreshTokenTTL > 0 && info.RefreshTokenTTL < refreshTokenTTL {
+		expiresAt = now.Add(info.RefreshTokenTTL)
+		maxExpiresAt = &expiresAt
+	}
+
+	authenticatedAt := now
+	if !info.AuthenticatedAt.IsZero() {
+		authenticatedAt = info.AuthenticatedAt
+	}
+
+	session := &models.Token{
+		ID:               uuid.New(),
+		UserID:           userID,
+		FamilyID:         uuid.New(),
+		RefreshTokenHash: utils.HashToken(refreshToken),
+		IPAddress:        info.IPAddress,
+		UserAgent:        utils.TruncateString(info.UserAgent, 512),
+		DeviceLabel:      utils.TruncateString(info.DeviceLabel, 100),
+		AuthenticatedAt:  authenticatedAt,
+		CreatedAt:        now,
+		LastUsedAt:       now,
+		ExpiresAt:        expiresAt,
+		ClientID:         info.ClientID,
+		Scope:            info.Scope,
+		AccessTokenTTL:   info.AccessTokenTTL,
+		MaxExpiresAt:     maxExpiresAt,
+		JKT:              info.JKT,
+		LastIPAddress:    info.IPAddress,
+	}
+
+	err := s.Handler.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(session).Error; err != nil {
+			return err
+		}
+		return s.evictExcessSessions(tx, userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// RotateSession consumes the given refresh token and issues its successor in
+// the same family. Consuming a token that was already used counts as reuse
+// from ipAddress, the address of the caller.
+func (s *Service) RotateSession(current *models.Token, refreshToken, ipAddress, userAgent string) (*models.Token, error) {
+	now := time.Now()
+	expiresAt := now.Add(refreshTokenTTL)
+	if current.MaxExpiresAt != nil && expiresAt.After(*current.MaxExpiresAt) {
+		expiresAt = *current.MaxExpiresAt
+	}
+
+	parentID := current.ID
+	next := &models.Token{
+		ID:               uuid.New(),
+		UserID:           current.UserID,
+		FamilyID:         current.FamilyID,
+		ParentID:         &parentID,
+		RefreshTokenHash: utils.HashToken(refreshToken),
+		IPAddress:        current.IPAddress,
+		UserAgent:        utils.TruncateString(userAgent, 512),
+		DeviceLabel:      current.DeviceLabel,
+		AuthenticatedAt:  current.AuthenticatedAt,
+		CreatedAt:        now,
+		LastUsedAt:       now,
+		ExpiresAt:        expiresAt,
+		ClientID:         current.ClientID,
+		Scope:            current.Scope,
+		AccessTokenTTL:   current.AccessTokenTTL,
+		MaxExpiresAt:     current.MaxExpiresAt,
+		JKT:              current.JKT,
+
+		LastIPAddress:     current.LastIPAddress,
+		IPBindingDecision: current.IPBindingDecision,
+	}
+
+	err := s.Handler.DB.Transaction(func(tx *gorm.DB) error {
+		// the guard on used_at makes concurrent rotations of one token lose
+		consumed := tx.Model(&models.Token{}).
+			Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", current.ID).
+			Update("used_at", now)
+		if consumed.Error != nil {
+			return consumed.Error
+		}
+		if consumed.RowsAffected == 0 {
+			return ErrRefreshTokenReused
+		}
+		return tx.Create(next).Error
+	})
+	if errors.Is(err, ErrRefreshTokenReused) {
+		s.handleRefreshTokenReuse(current, ipAddress)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return next, nil
+}
+
+// ListSessions returns the latest refresh token of each live session of the
+// user, most recently used first.
+func (s *Service) ListSessions(userID uuid.UUID) ([]models.Token, error) {
+	var tokens []models.Token
+	err := activeTokens(s.Handler.DB).
+		Where("user_id = ?", userID).
+		Order("last_used_at DESC").
+		Find(&tokens).Error
+	return tokens, err
+}
+
+// RevokeFamily revokes every token of a session.
+func (s *Service) RevokeFamily(familyID uuid.UUID) error {
+	return s.Handler.DB.Transaction(func(tx *gorm.DB) error {
+		return revokeFamilies(tx, []uuid.UUID{familyID})
+	})
+}
+
+// RevokeSession signs the user out of one of their sessions.
+func (s *Service) RevokeSession(userID, sessionID uuid.UUID) error {
+	var count int64
+	err := s.Handler.DB.Model(&models.Token{}).
+		Where("user_id = ? AND family_id = ? AND revoked_at IS NULL", userID, sessionID).
+		Count(&count).Error
+	if err != nil {
 		return err
 	}
+	if count == 0 {
+		return ErrSessionNotFound
+	}
+
+	return s.RevokeFamily(sessionID)
+}
 
-	hashedToken, err := bcrypt.GenerateFromPassword([]byte(refreshToken), bcrypt.DefaultCost)
+// RevokeAllSessions signs the user out everywhere.
+func (s *Service) RevokeAllSessions(userID uuid.UUID) error {
+	return s.Handler.DB.Transaction(func(tx *gorm.DB) error {
+		return revokeUserSessions(tx, userID, uuid.Nil)
+	})
+}
+
+// revokeUserSessions revokes every session of the user except keep.
+func revokeUserSessions(tx *gorm.DB, userID, keep uuid.UUID) error {
+	var familyIDs []uuid.UUID
+	err := tx.Model(&models.Token{}).
+		Where("user_id = ? AND family_id <> ? AND revoked_at IS NULL", userID, keep).
+		Distinct().
+		Pluck("family_id", &familyIDs).Error
+	if err != nil || len(familyIDs) == 0 {
+		return err
+	}
+	return revokeFamilies(tx, familyIDs)
+}
+
+// RevokeClientSessions ends every session opened through an OAuth client.
+func (s *Service) RevokeClientSessions(clientID string) error {
+	return s.Handler.DB.Transaction(func(tx *gorm.DB) error {
+		var familyIDs []uuid.UUID
+		err := tx.Model(&models.Token{}).
+			Where("client_id = ? AND revoked_at IS NULL", clientID).
+			Distinct().
+			Pluck("family_id", &familyIDs).Error
+		if err != nil || len(familyIDs) == 0 {
+			return err
+		}
+		return revokeFamilies(tx, familyIDs)
+	})
+}
+
+// revokeFamilies revokes the refresh tokens of the given families and
+// denylists the access tokens issued alongside them that have not expired yet.
+func revokeFamilies(tx *gorm.DB, familyIDs []uuid.UUID) error {
+	now := time.Now()
+
+	var issued []models.Token
+	err := tx.Select("id", "user_id", "created_at").
+		Where("family_id IN ? AND created_at > ?", familyIDs, now.Add(-utils.AccessTokenTTL)).
+		Find(&issued).Error
 	if err != nil {
 		return err
 	}
 
-	token := &models.Token{
-		ID:               uuid.New(),
-		UserID:           userID,
-		RefreshTokenHash: string(hashedToken),
-		IPAddress:        ipAddress,
-		CreatedAt:        time.Now(),
-		ExpiresAt:        time.Now().Add(30 * 24 * time.Hour),
+	for _, token := range issued {
+		if err := denyAccessToken(tx, token.ID.String(), token.UserID, token.CreatedAt.Add(utils.AccessTokenTTL)); err != nil {
+			return err
+		}
 	}
 
-	return s.Handler.DB.Create(token).Error
+	return tx.Model(&models.Token{}).
+		Where("family_id IN ? AND revoked_at IS NULL", familyIDs).
+		Update("revoked_at", now).Error
 }
 
-func (s *Service) ValidateRefreshToken(refreshToken, accessToken, ipAddress string) (bool, error) {
-	userIDStr, err := utils.ExtractUserIDFromToken(accessToken, s.Config.JWTSecretKey)
+// DenyAccessToken denylists a single access token until it expires.
+func (s *Service) DenyAccessToken(jti string, userID uuid.UUID, expiresAt time.Time) error {
+	return denyAccessToken(s.Handler.DB, jti, userID, expiresAt)
+}
+
+func denyAccessToken(tx *gorm.DB, jti string, userID uuid.UUID, expiresAt time.Time) error {
+	revoked := &models.RevokedAccessToken{
+		JTI:       jti,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
+		RevokedAt: time.Now(),
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(revoked).Error
+}
+
+// IsRevoked implements utils.Denylist.
+func (s *Service) IsRevoked(jti string) (bool, error) {
+	var count int64
+	err := s.Handler.DB.Model(&models.RevokedAccessToken{}).
+		Where("jti = ? AND expires_at > NOW()", jti).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// Remember implements utils.ProofReplayCache. The primary key makes a second
+// insert of the same proof a no-op, which is how a replay is detected.
+func (s *Service) Remember(id string, expiresAt time.Time) (bool, error) {
+	result := s.Handler.DB.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.DPoPProof{ID: id, ExpiresAt: expiresAt})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (s *Service) evictExcessSessions(tx *gorm.DB, userID uuid.UUID) error {
+	limit := s.Config.MaxSessionsPerUser
+	if limit <= 0 {
+		return nil
+	}
+
+	var excess []uuid.UUID
+	err := activeTokens(tx).
+		Where("user_id = ?", userID).
+		Order("last_used_at DESC, created_at DESC").
+		Offset(limit).
+		Pluck("family_id", &excess).Error
+	if err != nil || len(excess) == 0 {
+		return err
+	}
+
+	return revokeFamilies(tx, excess)
+}
+
+// activeTokens scopes a query to the current refresh token of each live
+// session.
+func activeTokens(tx *gorm.DB) *gorm.DB {
+	return tx.Model(&models.Token{}).
+		Where("used_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()")
+}
+
+// ValidateRefreshToken returns the token record for a refresh token that may
+// still be exchanged. Presenting a token that was already consumed revokes
+// the whole family. jkt is the thumbprint of the DPoP proof sent along, which
+// sessions bound to a key require.
+func (s *Service) ValidateRefreshToken(refreshToken, accessToken, ipAddress, jkt string) (*models.Token, error) {
+	userIDStr, err := utils.ExtractUserIDFromToken(accessToken, s.Verifier())
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	userID, err := utils.ConvertStringToUUID(userIDStr)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	var token models.Token
-	if err := s.Handler.DB.Where("user_id = ? AND expires_at > NOW()", userID).First(&token).Error; err != nil {
-		return false, err
+	token, err := s.LookupRefreshToken(refreshToken, ipAddress)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(token.RefreshTokenHash), []byte(refreshToken)); err != nil {
-		return false, err
+	// sessions of OAuth clients are refreshed through the token endpoint
+	if token.UserID != userID || token.ClientID != "" {
+		return nil, ErrInvalidRefreshToken
 	}
 
-	user, err := s.GetUserByID(userID)
-	if err != nil {
-		return false, err
+	if token.JKT != "" && jkt != token.JKT {
+		return nil, ErrDPoPKeyMismatch
 	}
 
-	if token.IPAddress != ipAddress {
+	if _, err := s.GetUserByID(userID); err != nil {
+		return nil, err
+	}
+
+	if err := s.CheckSessionIP(token, ipAddress, s.IPBindingPolicy()); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// CheckSessionIP applies an IP binding policy to a session refreshed from
+// ipAddress and records the decision on the token, from where RotateSession
+// carries it over. Sessions bound to a DPoP key are exempt, the proof already
+// ties them to their holder. A rejection is stored right away, since no
+// successor will be issued.
+func (s *Service) CheckSessionIP(token *models.Token, ipAddress string, policy utils.IPBindingPolicy) error {
+	decision := utils.IPDecisionSkipped
+	if token.JKT == "" {
+		decision = policy.Decide(token.IPAddress, ipAddress)
+	}
+
+	// only report an address once, not on every refresh made from it
+	if decision.Changed() && ipAddress != token.LastIPAddress {
+		s.reportIPAddressChange(token, ipAddress, policy.Mode, decision)
+	}
+
+	token.LastIPAddress = ipAddress
+	token.IPBindingDecision = string(decision)
+
+	if !decision.Allowed() {
+		err := s.Handler.DB.Model(&models.Token{}).Where("id = ?", token.ID).Updates(map[string]interface{}{
+			"last_ip_address":     token.LastIPAddress,
+			"ip_binding_decision": token.IPBindingDecision,
+		}).Error
+		if err != nil {
+			log.Printf("failed to record IP binding decision of token %s: %v", token.ID, err)
+		}
+		return ErrIPAddressMismatch
+	}
+	return nil
+}
+
+func (s *Service) reportIPAddressChange(token *models.Token, ipAddress string, mode utils.IPBindingMode, decision utils.IPBindingDecision) {
+	s.RecordSecurityEvent(models.SecurityEvent{
+		UserID:    token.UserID,
+		Type:      models.SecurityEventIPAddressChanged,
+		IPAddress: ipAddress,
+		Details: fmt.Sprintf("session %s opened from %s refreshed from %s: %s under %s binding",
+			token.FamilyID, token.IPAddress, ipAddress, decision, mode),
+	})
+
+	if decision == utils.IPDecisionSameSubnet {
+		return
+	}
+	if user, err := s.GetUserByID(token.UserID); err == nil {
 		s.MockSendEmailWarning(user.Email, token.IPAddress, ipAddress)
-		return false, fmt.Errorf("IP address mismatch")
+	}
+}
+
+// LookupRefreshToken finds the live refresh token. Presenting one that was
+// already rotated revokes its whole family.
+func (s *Service) LookupRefreshToken(refreshToken, ipAddress string) (*models.Token, error) {
+	token, err := s.FindRefreshToken(refreshToken)
+	if err != nil {
+		return nil, err
 	}
 
-	return true, nil
+	if token.RevokedAt != nil || time.Now().After(token.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if token.UsedAt != nil {
+		s.handleRefreshTokenReuse(token, ipAddress)
+		return nil, ErrRefreshTokenReused
+	}
+
+	return token, nil
+}
+
+// FindRefreshToken returns the record of a refresh token whatever its state,
+// without treating a rotated token as reused.
+func (s *Service) FindRefreshToken(refreshToken string) (*models.Token, error) {
+	var token models.Token
+	if err := s.Handler.DB.Where("refresh_token_hash = ?", utils.HashToken(refreshToken)).First(&token).Error; err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	return &token, nil
+}
+
+// handleRefreshTokenReuse treats a replayed refresh token as a leak: both the
+// attacker and the legitimate client lose the session.
+func (s *Service) handleRefreshTokenReuse(token *models.Token, ipAddress string) {
+	if err := s.RevokeFamily(token.FamilyID); err != nil {
+		log.Printf("failed to revoke token family %s: %v", token.FamilyID, err)
+	}
+
+	s.RecordSecurityEvent(models.SecurityEvent{
+		UserID:    token.UserID,
+		Type:      models.SecurityEventRefreshTokenReuse,
+		IPAddress: ipAddress,
+		Details:   fmt.Sprintf("token %s of family %s presented again after rotation", token.ID, token.FamilyID),
+	})
+}
+
+// RecordSecurityEvent stores an audit record. Failures are logged rather than
+// returned, auditing must never block the request that triggered it.
+func (s *Service) RecordSecurityEvent(event models.SecurityEvent) {
+	log.Printf("security event %s for user %s from %s: %s", event.Type, event.UserID, event.IPAddress, event.Details)
+
+	event.ID = uuid.New()
+	event.CreatedAt = time.Now()
+	if err := s.Handler.DB.Create(&event).Error; err != nil {
+		log.Printf("failed to store security event: %v", err)
+	}
 }
 
 func (s *Service) CleanupExpiredTokens() error {
+	if err := s.Handler.DB.Where("expires_at < NOW()").Delete(&models.RevokedAccessToken{}).Error; err != nil {
+		return err
+	}
+	if err := s.Handler.DB.Where("expires_at < NOW()").Delete(&models.DPoPProof{}).Error; err != nil {
+		return err
+	}
+	if err := s.Handler.DB.Where("expires_at < NOW()").Delete(&models.PasswordReset{}).Error; err != nil {
+		return err
+	}
 	return s.Handler.DB.Where("expires_at < NOW()").Delete(&models.Token{}).Error
 }
 
@@ -0,0 +1,260 @@
+package oauth
+
+import (
+	"errors"
+	"log"
+	"test-task/internal/modules/auth"
+	authmodels "test-task/internal/modules/auth/models"
+	"test-task/internal/modules/oauth/models"
+	"test-task/pkg/utils"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const authorizationCodeTTL = 5 * time.Minute
+
+// AuthorizationRequest holds the parameters of a request to /oauth/authorize.
+type AuthorizationRequest struct {
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+
+	// OpenID Connect parameters
+	Nonce         string
+	Prompt        string
+	MaxAgeSeconds string
+}
+
+// Grant is what the token endpoint hands out: a session with its current
+// refresh token and the scope of the access token to mint for it.
+type Grant struct {
+	Session      *authmodels.Token
+	RefreshToken string
+	Scope        string
+	// Nonce of the authorization request the session was opened from
+	Nonce string
+}
+
+// ResolveClient finds the client of an authorization request and checks the
+// redirect URI against the registered ones. Until both are known to be valid
+// errors must be shown to the user instead of being redirected.
+func (s *Service) ResolveClient(clientID, redirectURI string) (*models.Client, *Error) {
+	client, err := s.GetClient(clientID)
+	if err != nil {
+		return nil, newError("invalid_request", "unknown client")
+	}
+
+	if redirectURI == "" || !client.RedirectURIs.Contains(redirectURI) {
+		return nil, newError("invalid_request", "redirect_uri is not registered for this client")
+	}
+	return client, nil
+}
+
+// ValidateAuthorizationRequest checks the remaining parameters and returns
+// the scope the client may ask the user for.
+func (s *Service) ValidateAuthorizationRequest(client *models.Client, request AuthorizationRequest) (string, *Error) {
+	if !client.AllowsGrant(GrantTypeAuthorizationCode) {
+		return "", newError("unauthorized_client", "the client may not use the authorization code grant")
+	}
+
+	if request.ResponseType != "code" {
+		return "", newError("unsupported_response_type", "only the code response type is supported")
+	}
+
+	if request.CodeChallenge == "" {
+		return "", newError("invalid_request", "code_challenge is required")
+	}
+	if request.CodeChallengeMethod != utils.PKCEMethodS256 {
+		return "", newError("invalid_request", "code_challenge_method must be S256")
+	}
+
+	if oauthErr := validateOIDCParameters(request); oauthErr != nil {
+		return "", oauthErr
+	}
+
+	scope, err := utils.NarrowScope(request.Scope, utils.ParseScope(client.Scope))
+	if err != nil {
+		return "", newError("invalid_scope", err.Error())
+	}
+	if oauthErr := s.checkOpenIDScope(scope); oauthErr != nil {
+		return "", oauthErr
+	}
+	return scope, nil
+}
+
+// CreateAuthorizationCode records the user's approval. The scope is narrowed
+// further to what the user is allowed. authTime is when the user last
+// entered their password.
+func (s *Service) CreateAuthorizationCode(client *models.Client, userID uuid.UUID, authTime time.Time, request AuthorizationRequest, scope string) (string, error) {
+	allowed, err := s.Auth.AllowedScopes(userID)
+	if err != nil {
+		return "", err
+	}
+
+	granted := utils.IntersectScope(scope, allowed)
+	if granted == "" {
+		return "", newError("invalid_scope", "none of the requested scopes can be granted to this user")
+	}
+
+	code, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	record := &models.AuthorizationCode{
+		CodeHash:      utils.HashToken(code),
+		ClientID:      client.ID,
+		UserID:        userID,
+		RedirectURI:   request.RedirectURI,
+		Scope:         granted,
+		CodeChallenge: request.CodeChallenge,
+		Nonce:         request.Nonce,
+		AuthTime:      authTime,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(authorizationCodeTTL),
+	}
+	if err := s.Handler.DB.Create(record).Error; err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// RedeemAuthorizationCode consumes a code and opens the session it grants.
+// A code presented twice revokes the session it was first redeemed for.
+func (s *Service) RedeemAuthorizationCode(client *models.Client, code, redirectURI, verifier string, info auth.SessionInfo) (*Grant, error) {
+	var record models.AuthorizationCode
+	if err := s.Handler.DB.Where("code_hash = ?", utils.HashToken(code)).First(&record).Error; err != nil {
+		return nil, errInvalidGrant
+	}
+
+	if record.ClientID != client.ID {
+		return nil, errInvalidGrant
+	}
+
+	if record.UsedAt != nil {
+		s.handleCodeReplay(&record, info.IPAddress)
+		return nil, errInvalidGrant
+	}
+
+	if time.Now().After(record.ExpiresAt) || record.RedirectURI != redirectURI {
+		return nil, errInvalidGrant
+	}
+
+	if !utils.VerifyPKCE(verifier, record.CodeChallenge) {
+		return nil, newError("invalid_grant", "code_verifier does not match the code challenge")
+	}
+
+	consumed := s.Handler.DB.Model(&models.AuthorizationCode{}).
+		Where("code_hash = ? AND used_at IS NULL", record.CodeHash).
+		Update("used_at", time.Now())
+	if consumed.Error != nil {
+		return nil, consumed.Error
+	}
+	if consumed.RowsAffected == 0 {
+		s.handleCodeReplay(&record, info.IPAddress)
+		return nil, errInvalidGrant
+	}
+
+	refreshToken, err := utils.GenerateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	info.ClientID = client.ID
+	info.DeviceLabel = client.Name
+	info.Scope = record.Scope
+	info.AuthenticatedAt = record.AuthTime
+	info.AccessTokenTTL = client.AccessTokenTTL()
+	info.RefreshTokenTTL = client.RefreshTokenTTL()
+	session, err := s.Auth.CreateSession(record.UserID, refreshToken, info)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Handler.DB.Model(&models.AuthorizationCode{}).
+		Where("code_hash = ?", record.CodeHash).
+		Update("session_id", session.FamilyID).Error
+	if err != nil {
+		log.Printf("failed to link authorization code to session %s: %v", session.FamilyID, err)
+	}
+
+	return &Grant{
+		Session:      session,
+		RefreshToken: refreshToken,
+		Scope:        session.Scope,
+		Nonce:        record.Nonce,
+	}, nil
+}
+
+func (s *Service) handleCodeReplay(record *models.AuthorizationCode, ipAddress string) {
+	if record.SessionID != nil {
+		if err := s.Auth.RevokeFamily(*record.SessionID); err != nil {
+			log.Printf("failed to revoke session %s: %v", *record.SessionID, err)
+		}
+	}
+
+	s.Auth.RecordSecurityEvent(authmodels.SecurityEvent{
+		UserID:    record.UserID,
+		Type:      authmodels.SecurityEventAuthorizationCodeReuse,
+		Actor:     "client:" + record.ClientID,
+		IPAddress: ipAddress,
+		Details:   "authorization code presented again after it was redeemed",
+	})
+}
+
+// RefreshSession rotates the refresh token of a session the client holds.
+// Sessions bound to a DPoP key need a proof by that key, jkt is its
+// thumbprint; others are checked against the IP binding policy, which the
+// client may override.
+// The scope may be narrowed for the new access token but never widened.
+func (s *Service) RefreshSession(client *models.Client, refreshToken, requestedScope, jkt, ipAddress, userAgent string) (*Grant, error) {
+	current, err := s.Auth.LookupRefreshToken(refreshToken, ipAddress)
+	if err != nil {
+		return nil, errInvalidGrant
+	}
+	if current.ClientID != client.ID {
+		return nil, errInvalidGrant
+	}
+	if current.JKT != "" && current.JKT != jkt {
+		return nil, newError("invalid_dpop_proof", "the refresh token is bound to another DPoP key")
+	}
+
+	policy := s.Auth.IPBindingPolicy().WithMode(utils.IPBindingMode(client.IPBindingMode))
+	if err := s.Auth.CheckSessionIP(current, ipAddress, policy); err != nil {
+		if errors.Is(err, auth.ErrIPAddressMismatch) {
+			return nil, newError("invalid_grant", "the refresh token was issued to another IP address")
+		}
+		return nil, err
+	}
+
+	scope, err := s.Auth.SessionScope(current, requestedScope)
+	if err != nil {
+		return nil, newError("invalid_scope", err.Error())
+	}
+
+	newRefreshToken, err := utils.GenerateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := s.Auth.RotateSession(current, newRefreshToken, ipAddress, userAgent)
+	if err != nil {
+		if errors.Is(err, auth.ErrRefreshTokenReused) {
+			return nil, errInvalidGrant
+		}
+		return nil, err
+	}
+
+	return &Grant{
+		Session:      next,
+		RefreshToken: newRefreshToken,
+		Scope:        scope,
+	}, nil
+}
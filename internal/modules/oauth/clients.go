@@ -0,0 +1,290 @@
+package oauth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"test-task/internal/modules/oauth/models"
+	"test-task/pkg/utils"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeRefreshToken      = "refresh_token"
+)
+
+// clientGrantTypes are the grants a client can be allowed. The
+// client_credentials grant belongs to service accounts.
+var clientGrantTypes = []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken, GrantTypeDeviceCode, GrantTypeTokenExchange}
+
+var (
+	ErrClientNotFound       = errors.New("client not found")
+	ErrInvalidClientName    = errors.New("client name is required")
+	ErrInvalidRedirectURIs  = errors.New("at least one redirect URI is required")
+	ErrInvalidRedirectURI   = errors.New("invalid redirect URI")
+	ErrUnsupportedGrantType = errors.New("unsupported grant type")
+	ErrPublicTokenExchange  = errors.New("public clients cannot use token exchange")
+	ErrInvalidTokenTTL      = errors.New("token lifetimes must not be negative and access tokens live at most 15 minutes")
+	ErrPublicClientNoSecret = errors.New("public clients have no secret")
+	ErrInvalidIPBindingMode = errors.New("ip_binding_mode must be strict, same_subnet, warn_only or off")
+)
+
+// ClientMetadata is what an admin sets about a client. Public cannot be
+// changed after the client was created.
+type ClientMetadata struct {
+	Name            string   `json:"name"`
+	RedirectURIs    []string `json:"redirect_uris"`
+	GrantTypes      []string `json:"grant_types"`
+	Scope           string   `json:"scope"`
+	Public          bool     `json:"public"`
+	AccessTokenTTL  int      `json:"access_token_ttl"`
+	RefreshTokenTTL int      `json:"refresh_token_ttl"`
+	RequireDPoP     bool     `json:"dpop_bound_access_tokens"`
+	IPBindingMode   string   `json:"ip_binding_mode"`
+}
+
+// ValidateRedirectURI accepts absolute URIs without a fragment that use
+// https, plain http on the loopback interface, or a private-use scheme of a
+// native app (RFC 8252).
+func ValidateRedirectURI(uri string) error {
+	parsed, err := url.Parse(uri)
+	if err != nil || !parsed.IsAbs() {
+		return fmt.Errorf("%w: %q must be absolute", ErrInvalidRedirectURI, uri)
+	}
+	if parsed.Fragment != "" || strings.Contains(uri, "#") {
+		return fmt.Errorf("%w: %q must not contain a fragment", ErrInvalidRedirectURI, uri)
+	}
+
+	switch parsed.Scheme {
+	case "https":
+		if parsed.Host == "" {
+			return fmt.Errorf("%w: %q has no host", ErrInvalidRedirectURI, uri)
+		}
+		return nil
+	case "http":
+		switch parsed.Hostname() {
+		case "localhost", "127.0.0.1", "::1":
+			return nil
+		}
+		return fmt.Errorf("%w: %q must use https", ErrInvalidRedirectURI, uri)
+	default:
+		// private-use schemes are reverse domain names, e.g. com.example.app
+		if strings.Contains(parsed.Scheme, ".") {
+			return nil
+		}
+		return fmt.Errorf("%w: %q uses an unsupported scheme", ErrInvalidRedirectURI, uri)
+	}
+}
+
+// CreateClient registers a client. The secret of a confidential client is
+// returned once and only its hash is kept.
+func (s *Service) CreateClient(metadata ClientMetadata, registeredBy string) (*models.Client, string, error) {
+	now := time.Now()
+	client := &models.Client{
+		ID:           uuid.NewString(),
+		Public:       metadata.Public,
+		RegisteredBy: utils.TruncateString(registeredBy, 255),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := s.applyClientMetadata(client, metadata); err != nil {
+		return nil, "", err
+	}
+
+	var secret string
+	if !client.Public {
+		var err error
+		if secret, err = utils.GenerateOpaqueToken(); err != nil {
+			return nil, "", err
+		}
+		client.SecretHash = utils.HashToken(secret)
+	}
+
+	if err := s.Handler.DB.Create(client).Error; err != nil {
+		return nil, "", err
+	}
+
+	return client, secret, nil
+}
+
+// UpdateClient replaces the metadata of a client. Sessions already opened
+// keep the scope and lifetimes they were granted.
+func (s *Service) UpdateClient(clientID string, metadata ClientMetadata) (*models.Client, error) {
+	client, err := s.GetClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata.Public = client.Public
+	if err := s.applyClientMetadata(client, metadata); err != nil {
+		return nil, err
+	}
+	client.UpdatedAt = time.Now()
+
+	if err := s.Handler.DB.Save(client).Error; err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// DeleteClient removes a client together with its pending codes and
+// consents, and signs its users out of every session it opened.
+func (s *Service) DeleteClient(clientID string) error {
+	if _, err := s.GetClient(clientID); err != nil {
+		return err
+	}
+
+	if err := s.Auth.RevokeClientSessions(clientID); err != nil {
+		return err
+	}
+
+	return s.Handler.DB.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&models.AuthorizationCode{}, &models.DeviceCode{}, &models.Consent{}} {
+			if err := tx.Where("client_id = ?", clientID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Where("id = ?", clientID).Delete(&models.Client{}).Error
+	})
+}
+
+// RotateClientSecret replaces the secret of a confidential client. The old
+// secret stops working at once.
+func (s *Service) RotateClientSecret(clientID string) (string, error) {
+	client, err := s.GetClient(clientID)
+	if err != nil {
+		return "", err
+	}
+	if client.Public {
+		return "", ErrPublicClientNoSecret
+	}
+
+	secret, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = s.Handler.DB.Model(client).
+		Updates(map[string]interface{}{"secret_hash": utils.HashToken(secret), "updated_at": time.Now()}).Error
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// isClientMetadataError reports whether err is about invalid metadata rather
+// than a failure to store it.
+func isClientMetadataError(err error) bool {
+	for _, target := range []error{
+		ErrInvalidClientName,
+		ErrInvalidRedirectURIs,
+		ErrInvalidRedirectURI,
+		ErrUnsupportedGrantType,
+		ErrPublicTokenExchange,
+		ErrInvalidTokenTTL,
+		ErrInvalidIPBindingMode,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyClientMetadata validates metadata and copies it onto the client.
+func (s *Service) applyClientMetadata(client *models.Client, metadata ClientMetadata) error {
+	if strings.TrimSpace(metadata.Name) == "" {
+		return ErrInvalidClientName
+	}
+
+	grantTypes := metadata.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = models.DefaultGrantTypes
+	}
+	for _, grantType := range grantTypes {
+		if !utils.ContainsScope(clientGrantTypes, grantType) {
+			return fmt.Errorf("%w %q", ErrUnsupportedGrantType, grantType)
+		}
+	}
+	if metadata.Public && utils.ContainsScope(grantTypes, GrantTypeTokenExchange) {
+		return ErrPublicTokenExchange
+	}
+
+	if utils.ContainsScope(grantTypes, GrantTypeAuthorizationCode) && len(metadata.RedirectURIs) == 0 {
+		return ErrInvalidRedirectURIs
+	}
+	for _, uri := range metadata.RedirectURIs {
+		if err := ValidateRedirectURI(uri); err != nil {
+			return err
+		}
+	}
+
+	if metadata.AccessTokenTTL < 0 || metadata.RefreshTokenTTL < 0 || metadata.AccessTokenTTL > int(utils.AccessTokenTTL.Seconds()) {
+		return ErrInvalidTokenTTL
+	}
+
+	var ipBindingMode utils.IPBindingMode
+	if metadata.IPBindingMode != "" {
+		var err error
+		if ipBindingMode, err = utils.ParseIPBindingMode(metadata.IPBindingMode); err != nil {
+			return ErrInvalidIPBindingMode
+		}
+	}
+
+	scope := metadata.Scope
+	if strings.TrimSpace(scope) == "" {
+		scope = utils.FormatScope(s.Config.UserScopes)
+	}
+
+	client.Name = utils.TruncateString(metadata.Name, 255)
+	client.RedirectURIs = metadata.RedirectURIs
+	client.GrantTypes = grantTypes
+	client.Scope = utils.FormatScope(utils.ParseScope(scope))
+	client.AccessTokenTTLSeconds = metadata.AccessTokenTTL
+	client.RefreshTokenTTLSeconds = metadata.RefreshTokenTTL
+	client.RequireDPoP = metadata.RequireDPoP
+	client.IPBindingMode = string(ipBindingMode)
+	return nil
+}
+
+func (s *Service) ListClients() ([]models.Client, error) {
+	var clients []models.Client
+	err := s.Handler.DB.Order("created_at DESC").Find(&clients).Error
+	return clients, err
+}
+
+func (s *Service) GetClient(clientID string) (*models.Client, error) {
+	var client models.Client
+	if err := s.Handler.DB.Where("id = ?", clientID).First(&client).Error; err != nil {
+		return nil, ErrClientNotFound
+	}
+	return &client, nil
+}
+
+// AuthenticateClient checks the credentials presented to the token endpoint.
+// Public clients identify themselves by client_id alone.
+func (s *Service) AuthenticateClient(clientID, secret string) (*models.Client, error) {
+	if clientID == "" {
+		return nil, errInvalidClient
+	}
+
+	client, err := s.GetClient(clientID)
+	if err != nil {
+		return nil, errInvalidClient
+	}
+
+	if client.Public {
+		return client, nil
+	}
+
+	if secret == "" || subtle.ConstantTimeCompare([]byte(utils.HashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, errInvalidClient
+	}
+	return client, nil
+}
@@ -0,0 +1,337 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"test-task/internal/modules/auth"
+	"test-task/internal/modules/oauth/models"
+	"test-task/pkg/utils"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// GrantTypeDeviceCode is the grant_type devices poll the token endpoint with.
+const GrantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+const (
+	deviceCodeTTL      = 10 * time.Minute
+	devicePollInterval = 5 * time.Second
+
+	// consonants only, so user codes are easy to type and never spell words,
+	// RFC 8628 section 6.1
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+
+	// an address that enters this many unknown user codes within the window
+	// is refused further lookups until the window passes, RFC 8628 section
+	// 5.1
+	maxUserCodeFailures   = 10
+	userCodeFailureWindow = 15 * time.Minute
+)
+
+var (
+	ErrUserCodeNotFound  = errors.New("the code is invalid or has expired")
+	ErrUserCodeThrottled = errors.New("too many invalid codes, try again later")
+)
+
+// userCodeLimiter counts the failed user code lookups of each client address,
+// so the short codes cannot be guessed. Counts are kept per instance.
+type userCodeLimiter struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+func (l *userCodeLimiter) recent(ipAddress string, now time.Time) []time.Time {
+	var recent []time.Time
+	for _, failedAt := range l.failures[ipAddress] {
+		if now.Sub(failedAt) < userCodeFailureWindow {
+			recent = append(recent, failedAt)
+		}
+	}
+	if len(recent) == 0 {
+		delete(l.failures, ipAddress)
+	} else {
+		l.failures[ipAddress] = recent
+	}
+	return recent
+}
+
+func (l *userCodeLimiter) allowed(ipAddress string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.recent(ipAddress, time.Now())) < maxUserCodeFailures
+}
+
+func (l *userCodeLimiter) fail(ipAddress string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failures == nil {
+		l.failures = make(map[string][]time.Time)
+	}
+	now := time.Now()
+	l.failures[ipAddress] = append(l.recent(ipAddress, now), now)
+}
+
+// DeviceAuthorization is the response of the device authorization endpoint
+// without the verification URIs, which depend on where the service runs.
+type DeviceAuthorization struct {
+	DeviceCode string
+	UserCode   string
+	ExpiresIn  int64
+	Interval   int
+}
+
+// StartDeviceAuthorization issues the codes of a new device authorization.
+func (s *Service) StartDeviceAuthorization(client *models.Client, requestedScope string) (*DeviceAuthorization, error) {
+	if !client.AllowsGrant(GrantTypeDeviceCode) {
+		return nil, newError("unauthorized_client", "the client may not use the device authorization grant")
+	}
+
+	scope, err := utils.NarrowScope(requestedScope, utils.ParseScope(client.Scope))
+	if err != nil {
+		return nil, newError("invalid_scope", err.Error())
+	}
+	if oauthErr := s.checkOpenIDScope(scope); oauthErr != nil {
+		return nil, oauthErr
+	}
+
+	deviceCode, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	userCodeHash := utils.HashToken(NormalizeUserCode(userCode))
+	// user codes are unique, so one an expired device code still holds is
+	// freed before it is handed out again
+	err = s.Handler.DB.Where("user_code_hash = ? AND expires_at < ?", userCodeHash, now).
+		Delete(&models.DeviceCode{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	record := &models.DeviceCode{
+		DeviceCodeHash: utils.HashToken(deviceCode),
+		UserCodeHash:   userCodeHash,
+		ClientID:       client.ID,
+		Scope:          scope,
+		PollInterval:   int(devicePollInterval.Seconds()),
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(deviceCodeTTL),
+	}
+	if err := s.Handler.DB.Create(record).Error; err != nil {
+		return nil, err
+	}
+
+	return &DeviceAuthorization{
+		DeviceCode: deviceCode,
+		UserCode:   userCode,
+		ExpiresIn:  int64(deviceCodeTTL.Seconds()),
+		Interval:   record.PollInterval,
+	}, nil
+}
+
+// CleanupExpiredTokens deletes expired device codes and login sessions along
+// with everything the auth service cleans up.
+func (s *Service) CleanupExpiredTokens() error {
+	if err := s.Handler.DB.Where("expires_at < NOW()").Delete(&models.DeviceCode{}).Error; err != nil {
+		return err
+	}
+	if err := s.Handler.DB.Where("expires_at < NOW()").Delete(&models.LoginSession{}).Error; err != nil {
+		return err
+	}
+	return s.Auth.CleanupExpiredTokens()
+}
+
+// LookupUserCode returns the pending device authorization of a user code and
+// the client that started it. Addresses entering too many unknown codes get
+// ErrUserCodeThrottled.
+func (s *Service) LookupUserCode(userCode, ipAddress string) (*models.DeviceCode, *models.Client, error) {
+	if !s.userCodes.allowed(ipAddress) {
+		return nil, nil, ErrUserCodeThrottled
+	}
+
+	record, client, err := s.lookupUserCode(userCode)
+	if errors.Is(err, ErrUserCodeNotFound) {
+		s.userCodes.fail(ipAddress)
+	}
+	return record, client, err
+}
+
+func (s *Service) lookupUserCode(userCode string) (*models.DeviceCode, *models.Client, error) {
+	normalized := NormalizeUserCode(userCode)
+	if len(normalized) != userCodeLength {
+		return nil, nil, ErrUserCodeNotFound
+	}
+
+	var record models.DeviceCode
+	err := s.Handler.DB.
+		Where("user_code_hash = ? AND approved_at IS NULL AND denied_at IS NULL AND expires_at > ?", utils.HashToken(normalized), time.Now()).
+		First(&record).Error
+	if err != nil {
+		return nil, nil, ErrUserCodeNotFound
+	}
+
+	client, err := s.GetClient(record.ClientID)
+	if err != nil {
+		return nil, nil, ErrUserCodeNotFound
+	}
+	return &record, client, nil
+}
+
+// ApproveDeviceCode records the user's approval. Like an authorization code
+// the scope is narrowed to what the user is allowed.
+func (s *Service) ApproveDeviceCode(record *models.DeviceCode, userID uuid.UUID, authTime time.Time) error {
+	allowed, err := s.Auth.AllowedScopes(userID)
+	if err != nil {
+		return err
+	}
+
+	granted := utils.IntersectScope(record.Scope, allowed)
+	if granted == "" {
+		return newError("invalid_scope", "none of the requested scopes can be granted to this user")
+	}
+
+	return s.decideDeviceCode(record, map[string]interface{}{
+		"user_id":     userID,
+		"auth_time":   authTime,
+		"scope":       granted,
+		"approved_at": time.Now(),
+	})
+}
+
+// DenyDeviceCode makes the device's next poll fail with access_denied.
+func (s *Service) DenyDeviceCode(record *models.DeviceCode) error {
+	return s.decideDeviceCode(record, map[string]interface{}{"denied_at": time.Now()})
+}
+
+func (s *Service) decideDeviceCode(record *models.DeviceCode, updates map[string]interface{}) error {
+	decided := s.Handler.DB.Model(&models.DeviceCode{}).
+		Where("device_code_hash = ? AND approved_at IS NULL AND denied_at IS NULL", record.DeviceCodeHash).
+		Updates(updates)
+	if decided.Error != nil {
+		return decided.Error
+	}
+	if decided.RowsAffected == 0 {
+		return ErrUserCodeNotFound
+	}
+	return nil
+}
+
+// RedeemDeviceCode answers a poll of the device. Until the user decides it
+// fails with authorization_pending, and with slow_down when the device polls
+// faster than the interval, which then grows by five seconds.
+func (s *Service) RedeemDeviceCode(client *models.Client, deviceCode string, info auth.SessionInfo) (*Grant, error) {
+	var record models.DeviceCode
+	if err := s.Handler.DB.Where("device_code_hash = ?", utils.HashToken(deviceCode)).First(&record).Error; err != nil {
+		return nil, errInvalidGrant
+	}
+
+	if record.ClientID != client.ID || record.UsedAt != nil {
+		return nil, errInvalidGrant
+	}
+
+	now := time.Now()
+	if now.After(record.ExpiresAt) {
+		return nil, newError("expired_token", "the device code has expired")
+	}
+
+	interval := time.Duration(record.PollInterval) * time.Second
+	if record.LastPolledAt != nil && now.Sub(*record.LastPolledAt) < interval {
+		record.PollInterval += int(devicePollInterval.Seconds())
+		err := s.Handler.DB.Model(&record).
+			Updates(map[string]interface{}{"poll_interval": record.PollInterval, "last_polled_at": now}).Error
+		if err != nil {
+			return nil, err
+		}
+		return nil, newError("slow_down", "the device is polling too often")
+	}
+	if err := s.Handler.DB.Model(&record).Update("last_polled_at", now).Error; err != nil {
+		return nil, err
+	}
+
+	switch {
+	case record.DeniedAt != nil:
+		return nil, newError("access_denied", "the user denied the request")
+	case record.ApprovedAt == nil || record.UserID == nil:
+		return nil, newError("authorization_pending", "")
+	}
+
+	consumed := s.Handler.DB.Model(&models.DeviceCode{}).
+		Where("device_code_hash = ? AND used_at IS NULL", record.DeviceCodeHash).
+		Update("used_at", now)
+	if consumed.Error != nil {
+		return nil, consumed.Error
+	}
+	if consumed.RowsAffected == 0 {
+		return nil, errInvalidGrant
+	}
+
+	refreshToken, err := utils.GenerateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	info.ClientID = client.ID
+	info.DeviceLabel = client.Name
+	info.Scope = record.Scope
+	info.AccessTokenTTL = client.AccessTokenTTL()
+	info.RefreshTokenTTL = client.RefreshTokenTTL()
+	if record.AuthTime != nil {
+		info.AuthenticatedAt = *record.AuthTime
+	}
+	session, err := s.Auth.CreateSession(*record.UserID, refreshToken, info)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Handler.DB.Model(&models.DeviceCode{}).
+		Where("device_code_hash = ?", record.DeviceCodeHash).
+		Update("session_id", session.FamilyID).Error
+	if err != nil {
+		log.Printf("failed to link device code to session %s: %v", session.FamilyID, err)
+	}
+
+	return &Grant{
+		Session:      session,
+		RefreshToken: refreshToken,
+		Scope:        session.Scope,
+	}, nil
+}
+
+// NormalizeUserCode makes user codes case-insensitive and ignores the dash
+// and spaces people type along with them.
+func NormalizeUserCode(userCode string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(userCode)))
+}
+
+// generateUserCode returns a code such as BCDF-GHJK.
+func generateUserCode() (string, error) {
+	var code strings.Builder
+	alphabetSize := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := 0; i < userCodeLength; i++ {
+		if i == userCodeLength/2 {
+			code.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			return "", err
+		}
+		code.WriteByte(userCodeAlphabet[n.Int64()])
+	}
+	return code.String(), nil
+}
@@ -0,0 +1,112 @@
+package oauth
+
+import (
+	"test-task/pkg/utils"
+	"time"
+)
+
+const (
+	// GrantTypeTokenExchange is the grant_type of token exchange, RFC 8693.
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// TokenExchangeRequest holds the parameters of a token exchange.
+type TokenExchangeRequest struct {
+	SubjectToken       string
+	SubjectTokenType   string
+	ActorToken         string
+	RequestedTokenType string
+	Audience           string
+	Resource           string
+	Scope              string
+}
+
+// ExchangedToken is the access token a token exchange issues.
+type ExchangedToken struct {
+	AccessToken string
+	ExpiresIn   int64
+	Scope       string
+}
+
+// ExchangeToken lets a service call another one on behalf of a user without
+// forwarding the user's token. The new token keeps the subject, narrows the
+// audience and scope, never outlives the subject token and names the caller
+// in its act claim. Delegating an already delegated token nests the
+// previous actor. The new token shares the jti of the subject token, so
+// revoking the user's session or the subject token revokes it too. DPoP bound
+// subject tokens are refused, the caller does not hold their key.
+func (s *Service) ExchangeToken(caller *Caller, request TokenExchangeRequest) (*ExchangedToken, error) {
+	if request.SubjectToken == "" {
+		return nil, newError("invalid_request", "subject_token is required")
+	}
+	if request.SubjectTokenType != TokenTypeAccessToken {
+		return nil, newError("invalid_request", "subject_token_type must be "+TokenTypeAccessToken)
+	}
+	if request.ActorToken != "" {
+		return nil, newError("invalid_request", "actor_token is not supported, the authenticated client is the actor")
+	}
+	if request.RequestedTokenType != "" && request.RequestedTokenType != TokenTypeAccessToken {
+		return nil, newError("invalid_request", "only access tokens can be requested")
+	}
+	if request.Resource != "" {
+		return nil, newError("invalid_target", "resource is not supported, use audience")
+	}
+
+	subject, err := s.Auth.Verifier().Verify(request.SubjectToken)
+	if err != nil {
+		return nil, newError("invalid_request", "subject_token is invalid")
+	}
+	if subject.Confirmation != nil {
+		return nil, newError("invalid_request", "DPoP bound subject tokens cannot be exchanged")
+	}
+
+	audience, err := s.Auth.ResolveAudience(request.Audience)
+	if err != nil {
+		return nil, newError("invalid_target", "the audience is not allowed")
+	}
+
+	scope, err := utils.NarrowScope(request.Scope, utils.ParseScope(subject.Scope))
+	if err != nil {
+		return nil, newError("invalid_scope", err.Error())
+	}
+
+	scopes := utils.ParseScope(scope)
+	var permissions []string
+	for _, permission := range subject.Permissions {
+		if utils.ContainsScope(scopes, permission) {
+			permissions = append(permissions, permission)
+		}
+	}
+
+	remaining := time.Until(subject.ExpiresAt.Time)
+	if remaining <= 0 {
+		return nil, newError("invalid_request", "subject_token has expired")
+	}
+	ttl := utils.EffectiveAccessTokenTTL(remaining)
+
+	accessToken, err := utils.GenerateAccessToken(utils.AccessTokenParams{
+		UserID:      subject.UserID,
+		SessionID:   subject.SessionID,
+		ClientID:    caller.ClientID,
+		Kind:        subject.Kind,
+		TokenID:     subject.ID,
+		Scope:       scope,
+		Roles:       subject.Roles,
+		Permissions: permissions,
+		Actor:       &utils.Actor{Subject: caller.ClientID, Actor: subject.Actor},
+		TTL:         ttl,
+		Issuer:      s.Config.JWTIssuer,
+		Audience:    audience,
+	}, s.Auth.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExchangedToken{
+		AccessToken: accessToken,
+		ExpiresIn:   int64(ttl.Seconds()),
+		Scope:       scope,
+	}, nil
+}
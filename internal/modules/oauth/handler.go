@@ -0,0 +1,983 @@
+package oauth
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"test-task/internal/config"
+	"test-task/internal/middleware"
+	"test-task/internal/modules/auth"
+	"test-task/internal/modules/oauth/models"
+	"test-task/pkg/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type Handler struct {
+	Service *Service
+	Config  *config.Config
+}
+
+func NewHandler(service *Service, cfg *config.Config) *Handler {
+	return &Handler{
+		Service: service,
+		Config:  cfg,
+	}
+}
+
+// TokenResponse is the successful response of the token endpoint.
+type TokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in"`
+	RefreshToken    string `json:"refresh_token,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+	IDToken         string `json:"id_token,omitempty"`
+}
+
+// DeviceAuthorizationResponse is the response of the device authorization
+// endpoint, RFC 8628 section 3.2.
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// loginCookie holds the login session of a browser at the authorization
+// endpoint.
+const loginCookie = "oauth_login"
+
+// AuthorizeHandler starts an authorization request. Browsers with a login
+// session that already approved the client are sent straight back to it,
+// everyone else gets the sign in and consent page.
+func (h *Handler) AuthorizeHandler(c *gin.Context) {
+	request := authorizationRequest(c.Query)
+
+	client, scope, ok := h.validateAuthorizationRequest(c, request)
+	if !ok {
+		return
+	}
+
+	login := h.currentLogin(c, request)
+	consented := login != nil && !request.HasPrompt("consent") && h.Service.HasConsent(login.UserID, client.ID, scope)
+
+	if request.HasPrompt("none") {
+		switch {
+		case login == nil:
+			redirectError(c, request, newError("login_required", "the user is not signed in"))
+		case !consented:
+			redirectError(c, request, newError("consent_required", "the user has not approved the client"))
+		default:
+			h.approve(c, client, login.UserID, login.AuthenticatedAt, request, scope)
+		}
+		return
+	}
+
+	if consented {
+		h.approve(c, client, login.UserID, login.AuthenticatedAt, request, scope)
+		return
+	}
+
+	h.renderAuthorizePage(c, http.StatusOK, client, request, scope, login, "")
+}
+
+// AuthorizeDecisionHandler handles the sign in and consent page. Without a
+// password the user must already have a login session that satisfies the
+// request.
+func (h *Handler) AuthorizeDecisionHandler(c *gin.Context) {
+	request := authorizationRequest(c.PostForm)
+
+	client, scope, ok := h.validateAuthorizationRequest(c, request)
+	if !ok {
+		return
+	}
+
+	if c.PostForm("decision") != "allow" {
+		redirectError(c, request, newError("access_denied", "the user denied the request"))
+		return
+	}
+
+	var login *models.LoginSession
+	if email, password := c.PostForm("email"), c.PostForm("password"); email != "" || password != "" {
+		userID, err := h.Service.Auth.AuthenticateUser(email, password)
+		if err != nil {
+			h.renderAuthorizePage(c, http.StatusUnauthorized, client, request, scope, nil, loginErrorMessage(err))
+			return
+		}
+
+		token, session, err := h.Service.StartLoginSession(userID)
+		if err != nil {
+			log.Printf("failed to start login session: %v", err)
+			redirectError(c, request, errServerError)
+			return
+		}
+		h.setLoginCookie(c, token, session)
+		login = session
+	} else {
+		login = h.currentLogin(c, request)
+		if login == nil || !h.validCSRFToken(c) {
+			h.renderAuthorizePage(c, http.StatusUnauthorized, client, request, scope, nil, "Please sign in to continue")
+			return
+		}
+	}
+
+	if err := h.Service.SaveConsent(login.UserID, client.ID, scope); err != nil {
+		log.Printf("failed to save consent: %v", err)
+	}
+
+	h.approve(c, client, login.UserID, login.AuthenticatedAt, request, scope)
+}
+
+// DeviceAuthorizationHandler starts a device authorization, RFC 8628. The
+// device shows the user code and polls the token endpoint with the device
+// code while the user approves it in a browser.
+func (h *Handler) DeviceAuthorizationHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+
+	clientID, secret, err := clientCredentials(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	client, err := h.Service.AuthenticateClient(clientID, secret)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	authorization, err := h.Service.StartDeviceAuthorization(client, c.PostForm("scope"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	verificationURI := h.baseURL(c) + path.Dir(c.Request.URL.Path) + "/device"
+	c.JSON(http.StatusOK, DeviceAuthorizationResponse{
+		DeviceCode:              authorization.DeviceCode,
+		UserCode:                authorization.UserCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?" + url.Values{"user_code": {authorization.UserCode}}.Encode(),
+		ExpiresIn:               authorization.ExpiresIn,
+		Interval:                authorization.Interval,
+	})
+}
+
+// DeviceHandler is the verification page of the device flow. It asks for the
+// user code unless the link carried one.
+func (h *Handler) DeviceHandler(c *gin.Context) {
+	userCode := c.Query("user_code")
+	if userCode == "" {
+		renderPage(c, http.StatusOK, devicePage, gin.H{})
+		return
+	}
+
+	record, client, err := h.Service.LookupUserCode(userCode, middleware.ClientIP(c))
+	if err != nil {
+		renderUserCodeError(c, err)
+		return
+	}
+
+	login := h.Service.LoginSession(h.loginToken(c))
+	h.renderDevicePage(c, http.StatusOK, client, record, userCode, login, "")
+}
+
+// DeviceDecisionHandler records the user's decision about a user code. Like
+// the authorization page it takes a password or an existing login session,
+// for denying as much as for approving, so nobody else can cancel a device's
+// request.
+func (h *Handler) DeviceDecisionHandler(c *gin.Context) {
+	userCode := c.PostForm("user_code")
+	record, client, err := h.Service.LookupUserCode(userCode, middleware.ClientIP(c))
+	if err != nil {
+		renderUserCodeError(c, err)
+		return
+	}
+
+	var login *models.LoginSession
+	if email, password := c.PostForm("email"), c.PostForm("password"); email != "" || password != "" {
+		userID, err := h.Service.Auth.AuthenticateUser(email, password)
+		if err != nil {
+			h.renderDevicePage(c, http.StatusUnauthorized, client, record, userCode, nil, loginErrorMessage(err))
+			return
+		}
+
+		token, session, err := h.Service.StartLoginSession(userID)
+		if err != nil {
+			log.Printf("failed to start login session: %v", err)
+			renderPage(c, http.StatusInternalServerError, errorPage, errServerError)
+			return
+		}
+		h.setLoginCookie(c, token, session)
+		login = session
+	} else {
+		login = h.Service.LoginSession(h.loginToken(c))
+		if login == nil || !h.validCSRFToken(c) {
+			h.renderDevicePage(c, http.StatusUnauthorized, client, record, userCode, nil, "Please sign in to continue")
+			return
+		}
+	}
+
+	if c.PostForm("decision") != "allow" {
+		if err := h.Service.DenyDeviceCode(record); err != nil && !errors.Is(err, ErrUserCodeNotFound) {
+			log.Printf("failed to deny device code: %v", err)
+		}
+		renderPage(c, http.StatusOK, devicePage, gin.H{"Done": "Access denied"})
+		return
+	}
+
+	if err := h.Service.ApproveDeviceCode(record, login.UserID, login.AuthenticatedAt); err != nil {
+		var oauthErr *Error
+		switch {
+		case errors.As(err, &oauthErr):
+			h.renderDevicePage(c, http.StatusForbidden, client, record, userCode, login, oauthErr.Description)
+		case errors.Is(err, ErrUserCodeNotFound):
+			renderPage(c, http.StatusNotFound, devicePage, gin.H{"Error": err.Error()})
+		default:
+			log.Printf("failed to approve device code: %v", err)
+			renderPage(c, http.StatusInternalServerError, errorPage, errServerError)
+		}
+		return
+	}
+
+	renderPage(c, http.StatusOK, devicePage, gin.H{"Done": "Device connected"})
+}
+
+// TokenHandler implements the token endpoint for the authorization_code,
+// device_code, refresh_token, client_credentials and token exchange grants.
+func (h *Handler) TokenHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	clientID, secret, err := clientCredentials(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	grantType := c.PostForm("grant_type")
+	switch grantType {
+	case "client_credentials":
+		h.serviceAccountToken(c, clientID, secret)
+		return
+	case GrantTypeTokenExchange:
+		h.exchangeToken(c, clientID, secret)
+		return
+	}
+
+	client, err := h.Service.AuthenticateClient(clientID, secret)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if utils.ContainsScope(clientGrantTypes, grantType) && !client.AllowsGrant(grantType) {
+		respondError(c, newError("unauthorized_client", "the client may not use this grant type"))
+		return
+	}
+
+	jkt, err := h.dpopKey(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if client.RequireDPoP && jkt == "" {
+		respondError(c, newError("invalid_dpop_proof", "the client must send a DPoP proof"))
+		return
+	}
+
+	var grant *Grant
+	switch grantType {
+	case GrantTypeAuthorizationCode:
+		info := auth.SessionInfo{
+			IPAddress: middleware.ClientIP(c),
+			UserAgent: c.Request.UserAgent(),
+			JKT:       jkt,
+		}
+		grant, err = h.Service.RedeemAuthorizationCode(client, c.PostForm("code"), c.PostForm("redirect_uri"), c.PostForm("code_verifier"), info)
+	case GrantTypeDeviceCode:
+		info := auth.SessionInfo{
+			IPAddress: middleware.ClientIP(c),
+			UserAgent: c.Request.UserAgent(),
+			JKT:       jkt,
+		}
+		grant, err = h.Service.RedeemDeviceCode(client, c.PostForm("device_code"), info)
+	case GrantTypeRefreshToken:
+		grant, err = h.Service.RefreshSession(client, c.PostForm("refresh_token"), c.PostForm("scope"), jkt, middleware.ClientIP(c), c.Request.UserAgent())
+	case "":
+		err = newError("invalid_request", "grant_type is required")
+	default:
+		err = newError("unsupported_grant_type", "")
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	h.respondTokens(c, grant)
+}
+
+// serviceAccountToken answers the client_credentials grant. There is no user
+// to come back for, so no refresh token is issued.
+func (h *Handler) serviceAccountToken(c *gin.Context, clientID, secret string) {
+	account, err := h.Service.AuthenticateServiceAccount(clientID, secret)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	accessToken, scope, err := h.Service.IssueServiceAccountToken(account, c.PostForm("scope"), middleware.ClientIP(c))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(utils.AccessTokenTTL.Seconds()),
+		Scope:       scope,
+	})
+}
+
+// exchangeToken answers a token exchange. Only confidential clients and
+// service accounts can act on behalf of a user.
+func (h *Handler) exchangeToken(c *gin.Context, clientID, secret string) {
+	caller, err := h.Service.AuthenticateCaller(clientID, secret)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if caller.Public || (caller.Client != nil && !caller.Client.AllowsGrant(GrantTypeTokenExchange)) {
+		respondError(c, newError("unauthorized_client", "the client may not exchange tokens"))
+		return
+	}
+
+	exchanged, err := h.Service.ExchangeToken(caller, TokenExchangeRequest{
+		SubjectToken:       c.PostForm("subject_token"),
+		SubjectTokenType:   c.PostForm("subject_token_type"),
+		ActorToken:         c.PostForm("actor_token"),
+		RequestedTokenType: c.PostForm("requested_token_type"),
+		Audience:           c.PostForm("audience"),
+		Resource:           c.PostForm("resource"),
+		Scope:              c.PostForm("scope"),
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, TokenResponse{
+		AccessToken:     exchanged.AccessToken,
+		IssuedTokenType: TokenTypeAccessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       exchanged.ExpiresIn,
+		Scope:           exchanged.Scope,
+	})
+}
+
+// RegisterHandler implements dynamic client registration, RFC 7591, for
+// holders of an initial access token.
+func (h *Handler) RegisterHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+
+	header := c.GetHeader("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	registeredBy, ok := h.Service.RegistrationCredential(token)
+	if token == header || !ok {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, newError("invalid_token", "a valid initial access token is required"))
+		return
+	}
+
+	var request RegistrationRequest
+	if err := c.BindJSON(&request); err != nil {
+		respondError(c, newError("invalid_client_metadata", "invalid request body"))
+		return
+	}
+
+	response, err := h.Service.RegisterClient(request, registeredBy)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	log.Printf("client %s registered with initial access token %s", response.ClientID, registeredBy)
+	c.JSON(http.StatusCreated, response)
+}
+
+// IntrospectHandler implements token introspection for confidential clients
+// and service accounts, RFC 7662.
+func (h *Handler) IntrospectHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+
+	caller, ok := h.authenticateCaller(c)
+	if !ok {
+		return
+	}
+	if caller.Public {
+		respondError(c, errInvalidClient)
+		return
+	}
+
+	token := c.PostForm("token")
+	if token == "" {
+		respondError(c, newError("invalid_request", "token is required"))
+		return
+	}
+
+	c.JSON(http.StatusOK, h.Service.Introspect(caller, token, c.PostForm("token_type_hint")))
+}
+
+// RevokeHandler implements token revocation, RFC 7009. It answers 200 for
+// tokens it does not know as well.
+func (h *Handler) RevokeHandler(c *gin.Context) {
+	caller, ok := h.authenticateCaller(c)
+	if !ok {
+		return
+	}
+
+	token := c.PostForm("token")
+	if token == "" {
+		respondError(c, newError("invalid_request", "token is required"))
+		return
+	}
+
+	if err := h.Service.Revoke(caller, token, c.PostForm("token_type_hint")); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func (h *Handler) authenticateCaller(c *gin.Context) (*Caller, bool) {
+	clientID, secret, err := clientCredentials(c)
+	if err != nil {
+		respondError(c, err)
+		return nil, false
+	}
+
+	caller, err := h.Service.AuthenticateCaller(clientID, secret)
+	if err != nil {
+		respondError(c, err)
+		return nil, false
+	}
+	return caller, true
+}
+
+// UserInfoHandler returns claims about the user an access token was issued
+// for.
+func (h *Handler) UserInfoHandler(c *gin.Context) {
+	principal := middleware.CurrentPrincipal(c)
+
+	claims, err := h.Service.UserInfo(principal.UserID, principal.Scopes)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, claims)
+}
+
+// DiscoveryHandler publishes the OpenID Provider metadata. apiPrefix is the
+// path the OAuth routes are registered under.
+func (h *Handler) DiscoveryHandler(apiPrefix string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		baseURL := h.baseURL(c)
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, h.Service.Discovery(baseURL, baseURL+apiPrefix))
+	}
+}
+
+func (h *Handler) CreateClientHandler(c *gin.Context) {
+	var metadata ClientMetadata
+	if err := c.BindJSON(&metadata); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	client, secret, err := h.Service.CreateClient(metadata, c.GetString(middleware.AdminContextKey))
+	if err != nil {
+		respondClientError(c, err)
+		return
+	}
+
+	log.Printf("client %s created by %s", client.ID, c.GetString(middleware.AdminContextKey))
+	response := gin.H{"client": client}
+	if secret != "" {
+		response["client_secret"] = secret
+	}
+	c.JSON(http.StatusCreated, response)
+}
+
+func (h *Handler) ListClientsHandler(c *gin.Context) {
+	clients, err := h.Service.ListClients()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list clients"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"clients": clients})
+}
+
+func (h *Handler) GetClientHandler(c *gin.Context) {
+	client, err := h.Service.GetClient(c.Param("id"))
+	if err != nil {
+		respondClientError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, client)
+}
+
+func (h *Handler) UpdateClientHandler(c *gin.Context) {
+	var metadata ClientMetadata
+	if err := c.BindJSON(&metadata); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	client, err := h.Service.UpdateClient(c.Param("id"), metadata)
+	if err != nil {
+		respondClientError(c, err)
+		return
+	}
+
+	log.Printf("client %s updated by %s", client.ID, c.GetString(middleware.AdminContextKey))
+	c.JSON(http.StatusOK, client)
+}
+
+func (h *Handler) DeleteClientHandler(c *gin.Context) {
+	if err := h.Service.DeleteClient(c.Param("id")); err != nil {
+		respondClientError(c, err)
+		return
+	}
+
+	log.Printf("client %s deleted by %s", c.Param("id"), c.GetString(middleware.AdminContextKey))
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handler) RotateClientSecretHandler(c *gin.Context) {
+	secret, err := h.Service.RotateClientSecret(c.Param("id"))
+	if err != nil {
+		respondClientError(c, err)
+		return
+	}
+
+	log.Printf("secret of client %s rotated by %s", c.Param("id"), c.GetString(middleware.AdminContextKey))
+	c.JSON(http.StatusOK, gin.H{"client_id": c.Param("id"), "client_secret": secret})
+}
+
+func respondClientError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrClientNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case isClientMetadataError(err), errors.Is(err, ErrPublicClientNoSecret):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Printf("client request failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not update client"})
+	}
+}
+
+func (h *Handler) CreateServiceAccountHandler(c *gin.Context) {
+	var requestBody struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Owner       string   `json:"owner"`
+		Team        string   `json:"team"`
+		Scope       string   `json:"scope"`
+		Permissions []string `json:"permissions"`
+	}
+
+	if err := c.BindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	// admin API keys hold every permission, users and service accounts can
+	// only hand on the ones they hold themselves
+	if principal := middleware.CurrentPrincipal(c); principal != nil {
+		for _, permission := range requestBody.Permissions {
+			if !principal.HasPermission(permission) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "cannot grant permission " + permission + " you do not hold"})
+				return
+			}
+		}
+	}
+
+	account, secret, err := h.Service.CreateServiceAccount(models.ServiceAccount{
+		Name:        requestBody.Name,
+		Description: requestBody.Description,
+		Owner:       requestBody.Owner,
+		Team:        requestBody.Team,
+		Scope:       requestBody.Scope,
+		Permissions: requestBody.Permissions,
+	})
+	if err != nil {
+		respondServiceAccountError(c, err)
+		return
+	}
+
+	log.Printf("service account %s created by %s", account.ClientID, c.GetString(middleware.AdminContextKey))
+	c.JSON(http.StatusCreated, gin.H{"service_account": account, "client_secret": secret})
+}
+
+func (h *Handler) ListServiceAccountsHandler(c *gin.Context) {
+	accounts, err := h.Service.ListServiceAccounts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list service accounts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"service_accounts": accounts})
+}
+
+func (h *Handler) RotateServiceAccountSecretHandler(c *gin.Context) {
+	id, err := utils.ConvertStringToUUID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid service account id"})
+		return
+	}
+
+	secret, previousExpiresAt, err := h.Service.RotateServiceAccountSecret(id)
+	if err != nil {
+		respondServiceAccountError(c, err)
+		return
+	}
+
+	log.Printf("secret of service account %s rotated by %s", id, c.GetString(middleware.AdminContextKey))
+	c.JSON(http.StatusOK, gin.H{"client_secret": secret, "previous_secret_expires_at": previousExpiresAt})
+}
+
+func (h *Handler) DisableServiceAccountHandler(c *gin.Context) {
+	h.setServiceAccountDisabled(c, true)
+}
+
+func (h *Handler) EnableServiceAccountHandler(c *gin.Context) {
+	h.setServiceAccountDisabled(c, false)
+}
+
+func (h *Handler) setServiceAccountDisabled(c *gin.Context, disabled bool) {
+	id, err := utils.ConvertStringToUUID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid service account id"})
+		return
+	}
+
+	account, err := h.Service.SetServiceAccountDisabled(id, disabled)
+	if err != nil {
+		respondServiceAccountError(c, err)
+		return
+	}
+
+	log.Printf("service account %s disabled=%t by %s", id, disabled, c.GetString(middleware.AdminContextKey))
+	c.JSON(http.StatusOK, account)
+}
+
+func respondServiceAccountError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrServiceAccountNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidServiceAccount), errors.Is(err, ErrUnknownPermission):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not update service account"})
+	}
+}
+
+func renderUserCodeError(c *gin.Context, err error) {
+	status := http.StatusNotFound
+	if errors.Is(err, ErrUserCodeThrottled) {
+		status = http.StatusTooManyRequests
+	}
+	renderPage(c, status, devicePage, gin.H{"Error": err.Error()})
+}
+
+func (h *Handler) renderDevicePage(c *gin.Context, status int, client *models.Client, record *models.DeviceCode, userCode string, login *models.LoginSession, message string) {
+	normalized := NormalizeUserCode(userCode)
+	data := gin.H{
+		"Client":   client,
+		"UserCode": normalized[:userCodeLength/2] + "-" + normalized[userCodeLength/2:],
+		"Scopes":   utils.ParseScope(record.Scope),
+		"Error":    message,
+	}
+
+	if login != nil {
+		if user, err := h.Service.Auth.GetUserByID(login.UserID); err == nil {
+			data["Email"] = user.Email
+			data["CSRFToken"] = csrfToken(h.loginToken(c))
+		}
+	}
+
+	renderPage(c, status, devicePage, data)
+}
+
+// validateAuthorizationRequest writes the error response itself when the
+// request is invalid. Problems with the client or redirect URI are shown to
+// the user, everything else is reported back to the client.
+func (h *Handler) validateAuthorizationRequest(c *gin.Context, request AuthorizationRequest) (*models.Client, string, bool) {
+	client, oauthErr := h.Service.ResolveClient(request.ClientID, request.RedirectURI)
+	if oauthErr != nil {
+		renderPage(c, http.StatusBadRequest, errorPage, oauthErr)
+		return nil, "", false
+	}
+
+	scope, oauthErr := h.Service.ValidateAuthorizationRequest(client, request)
+	if oauthErr != nil {
+		redirectError(c, request, oauthErr)
+		return nil, "", false
+	}
+
+	return client, scope, true
+}
+
+// renderAuthorizePage asks for the password unless login is set, in which
+// case the user only has to approve the client.
+func (h *Handler) renderAuthorizePage(c *gin.Context, status int, client *models.Client, request AuthorizationRequest, scope string, login *models.LoginSession, message string) {
+	data := gin.H{
+		"Client":  client,
+		"Request": request,
+		"Scopes":  utils.ParseScope(scope),
+		"Error":   message,
+	}
+
+	if login != nil {
+		if user, err := h.Service.Auth.GetUserByID(login.UserID); err == nil {
+			data["Email"] = user.Email
+			data["CSRFToken"] = csrfToken(h.loginToken(c))
+		}
+	}
+
+	renderPage(c, status, authorizePage, data)
+}
+
+// approve redirects back to the client with an authorization code.
+func (h *Handler) approve(c *gin.Context, client *models.Client, userID uuid.UUID, authTime time.Time, request AuthorizationRequest, scope string) {
+	code, err := h.Service.CreateAuthorizationCode(client, userID, authTime, request, scope)
+	if err != nil {
+		var oauthErr *Error
+		if errors.As(err, &oauthErr) {
+			redirectError(c, request, oauthErr)
+			return
+		}
+		log.Printf("failed to create authorization code: %v", err)
+		redirectError(c, request, errServerError)
+		return
+	}
+
+	redirect(c, request, url.Values{"code": {code}})
+}
+
+// currentLogin returns the login session of the browser when it satisfies
+// the request: prompt=login and an exceeded max_age both ask for the
+// password again.
+func (h *Handler) currentLogin(c *gin.Context, request AuthorizationRequest) *models.LoginSession {
+	if request.HasPrompt("login") {
+		return nil
+	}
+
+	login := h.Service.LoginSession(h.loginToken(c))
+	if login == nil {
+		return nil
+	}
+
+	if maxAge, ok := request.MaxAge(); ok && time.Since(login.AuthenticatedAt) > maxAge {
+		return nil
+	}
+	return login
+}
+
+func (h *Handler) loginToken(c *gin.Context) string {
+	token, err := c.Cookie(loginCookie)
+	if err != nil {
+		return ""
+	}
+	return token
+}
+
+// loginErrorMessage tells users who typed the right password but still have
+// to verify their address what is wrong.
+func loginErrorMessage(err error) string {
+	if errors.Is(err, auth.ErrEmailNotVerified) {
+		return "Please verify your email address before signing in"
+	}
+	return "Invalid email or password"
+}
+
+func (h *Handler) setLoginCookie(c *gin.Context, token string, session *models.LoginSession) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(loginCookie, token, int(time.Until(session.ExpiresAt).Seconds()), path.Dir(c.Request.URL.Path), "", strings.HasPrefix(h.baseURL(c), "https://"), true)
+}
+
+// csrfToken ties the consent form to the login cookie, which other sites
+// cannot read.
+func csrfToken(loginToken string) string {
+	return utils.HashToken("consent:" + loginToken)
+}
+
+func (h *Handler) validCSRFToken(c *gin.Context) bool {
+	expected := csrfToken(h.loginToken(c))
+	return subtle.ConstantTimeCompare([]byte(c.PostForm("csrf_token")), []byte(expected)) == 1
+}
+
+// baseURL is the public URL of the service.
+func (h *Handler) baseURL(c *gin.Context) string {
+	if h.Config.PublicURL != "" {
+		return strings.TrimSuffix(h.Config.PublicURL, "/")
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+func authorizationRequest(param func(string) string) AuthorizationRequest {
+	return AuthorizationRequest{
+		ClientID:            param("client_id"),
+		RedirectURI:         param("redirect_uri"),
+		ResponseType:        param("response_type"),
+		Scope:               param("scope"),
+		State:               param("state"),
+		CodeChallenge:       param("code_challenge"),
+		CodeChallengeMethod: param("code_challenge_method"),
+		Nonce:               param("nonce"),
+		Prompt:              param("prompt"),
+		MaxAgeSeconds:       param("max_age"),
+	}
+}
+
+// clientCredentials reads client credentials from HTTP Basic authentication
+// or, failing that, from the request body.
+func clientCredentials(c *gin.Context) (string, string, error) {
+	clientID, secret, ok := c.Request.BasicAuth()
+	if !ok {
+		return c.PostForm("client_id"), c.PostForm("client_secret"), nil
+	}
+
+	// RFC 6749 section 2.3.1 form-encodes both values
+	clientID, err := url.QueryUnescape(clientID)
+	if err != nil {
+		return "", "", errInvalidClient
+	}
+	if secret, err = url.QueryUnescape(secret); err != nil {
+		return "", "", errInvalidClient
+	}
+	return clientID, secret, nil
+}
+
+func (h *Handler) respondTokens(c *gin.Context, grant *Grant) {
+	audience, err := h.Service.Auth.ResolveAudience("")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	accessToken, err := h.Service.Auth.IssueAccessToken(grant.Session, middleware.ClientIP(c), audience, grant.Scope)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	response := TokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    grant.Session.TokenType(),
+		ExpiresIn:    int64(utils.EffectiveAccessTokenTTL(grant.Session.AccessTokenTTL).Seconds()),
+		RefreshToken: grant.RefreshToken,
+		Scope:        grant.Scope,
+	}
+
+	// sessions opened with openid before the deployment went back to a shared
+	// secret keep working, without ID tokens
+	if utils.ContainsScope(utils.ParseScope(grant.Scope), ScopeOpenID) && h.Service.IssuesIDTokens() {
+		if response.IDToken, err = h.Service.IssueIDToken(grant.Session, grant.Nonce); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// dpopKey verifies the DPoP proof of a token request, if any, and returns the
+// thumbprint of its key.
+func (h *Handler) dpopKey(c *gin.Context) (string, error) {
+	jkt, err := middleware.DPoPKey(c, h.Service.Auth.DPoPVerifier(), "")
+	if errors.Is(err, utils.ErrInvalidDPoPProof) || errors.Is(err, utils.ErrDPoPProofReused) {
+		return "", newError("invalid_dpop_proof", err.Error())
+	}
+	return jkt, err
+}
+
+func respondError(c *gin.Context, err error) {
+	var oauthErr *Error
+	if !errors.As(err, &oauthErr) {
+		log.Printf("oauth request failed: %v", err)
+		oauthErr = errServerError
+	}
+
+	if oauthErr.Code == "invalid_client" {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	c.JSON(oauthErr.Status(), oauthErr)
+}
+
+func redirectError(c *gin.Context, request AuthorizationRequest, oauthErr *Error) {
+	params := url.Values{"error": {oauthErr.Code}}
+	if oauthErr.Description != "" {
+		params.Set("error_description", oauthErr.Description)
+	}
+	redirect(c, request, params)
+}
+
+// redirect sends the user back to the client, keeping any query the
+// registered redirect URI already has.
+func redirect(c *gin.Context, request AuthorizationRequest, params url.Values) {
+	target, err := url.Parse(request.RedirectURI)
+	if err != nil {
+		renderPage(c, http.StatusBadRequest, errorPage, newError("invalid_request", "invalid redirect_uri"))
+		return
+	}
+
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if request.State != "" {
+		query.Set("state", request.State)
+	}
+	target.RawQuery = query.Encode()
+
+	c.Redirect(http.StatusFound, target.String())
+}
+
+func renderPage(c *gin.Context, status int, page *template.Template, data interface{}) {
+	var body bytes.Buffer
+	if err := page.Execute(&body, data); err != nil {
+		log.Printf("failed to render page: %v", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+	c.Data(status, "text/html; charset=utf-8", body.Bytes())
+}
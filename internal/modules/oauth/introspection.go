@@ -0,0 +1,191 @@
+package oauth
+
+import (
+	"log"
+	"test-task/internal/modules/oauth/models"
+	"test-task/pkg/utils"
+	"time"
+)
+
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+// Caller is whoever authenticated at the introspection or revocation
+// endpoint: an OAuth client or a service account.
+type Caller struct {
+	ClientID string
+	Public   bool
+	// Client is nil for service accounts
+	Client *models.Client
+}
+
+// Introspection is the response of the introspection endpoint, RFC 7662
+// section 2.2. Inactive tokens only report active false.
+type Introspection struct {
+	Active    bool         `json:"active"`
+	Scope     string       `json:"scope,omitempty"`
+	ClientID  string       `json:"client_id,omitempty"`
+	TokenType string       `json:"token_type,omitempty"`
+	ExpiresAt int64        `json:"exp,omitempty"`
+	IssuedAt  int64        `json:"iat,omitempty"`
+	NotBefore int64        `json:"nbf,omitempty"`
+	Subject   string       `json:"sub,omitempty"`
+	Audience  []string     `json:"aud,omitempty"`
+	Issuer    string       `json:"iss,omitempty"`
+	TokenID   string       `json:"jti,omitempty"`
+	SessionID string       `json:"sid,omitempty"`
+	Kind      string       `json:"kind,omitempty"`
+	Actor     *utils.Actor `json:"act,omitempty"`
+	// Confirmation names the DPoP key a bound token is bound to
+	Confirmation *utils.Confirmation `json:"cnf,omitempty"`
+}
+
+// AuthenticateCaller accepts the credentials of a client or, failing that,
+// of a service account.
+func (s *Service) AuthenticateCaller(clientID, secret string) (*Caller, error) {
+	if client, err := s.AuthenticateClient(clientID, secret); err == nil {
+		return &Caller{ClientID: client.ID, Public: client.Public, Client: client}, nil
+	}
+
+	account, err := s.AuthenticateServiceAccount(clientID, secret)
+	if err != nil {
+		return nil, err
+	}
+	return &Caller{ClientID: account.ClientID}, nil
+}
+
+// Introspect reports whether a token is active. Access tokens are described
+// to any authenticated caller, the resource servers that receive them;
+// refresh tokens only to the client they were issued to.
+func (s *Service) Introspect(caller *Caller, token, hint string) *Introspection {
+	if hint == TokenTypeHintRefreshToken {
+		if result := s.introspectRefreshToken(caller, token); result != nil {
+			return result
+		}
+		if result := s.introspectAccessToken(token); result != nil {
+			return result
+		}
+	} else {
+		if result := s.introspectAccessToken(token); result != nil {
+			return result
+		}
+		if result := s.introspectRefreshToken(caller, token); result != nil {
+			return result
+		}
+	}
+	return &Introspection{Active: false}
+}
+
+func (s *Service) introspectAccessToken(token string) *Introspection {
+	claims, err := s.Auth.Verifier().Verify(token)
+	if err != nil {
+		return nil
+	}
+
+	result := &Introspection{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		TokenType: "Bearer",
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		Issuer:    claims.Issuer,
+		TokenID:   claims.ID,
+		SessionID: claims.SessionID,
+		Kind:      claims.Kind,
+		Actor:     claims.Actor,
+	}
+	if claims.Confirmation != nil {
+		result.TokenType = "DPoP"
+		result.Confirmation = claims.Confirmation
+	}
+	if claims.ExpiresAt != nil {
+		result.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		result.IssuedAt = claims.IssuedAt.Unix()
+	}
+	if claims.NotBefore != nil {
+		result.NotBefore = claims.NotBefore.Unix()
+	}
+	return result
+}
+
+func (s *Service) introspectRefreshToken(caller *Caller, token string) *Introspection {
+	record, err := s.Auth.FindRefreshToken(token)
+	if err != nil || record.ClientID == "" || record.ClientID != caller.ClientID {
+		return nil
+	}
+	if record.RevokedAt != nil || record.UsedAt != nil || time.Now().After(record.ExpiresAt) {
+		return nil
+	}
+
+	result := &Introspection{
+		Active:    true,
+		Scope:     record.Scope,
+		ClientID:  record.ClientID,
+		TokenType: TokenTypeHintRefreshToken,
+		ExpiresAt: record.ExpiresAt.Unix(),
+		IssuedAt:  record.CreatedAt.Unix(),
+		Subject:   record.UserID.String(),
+		Issuer:    s.Config.JWTIssuer,
+		SessionID: record.FamilyID.String(),
+	}
+	if record.JKT != "" {
+		result.Confirmation = &utils.Confirmation{JKT: record.JKT}
+	}
+	return result
+}
+
+// Revoke revokes a token issued to the caller, RFC 7009. Revoking a refresh
+// token ends its whole session, access tokens issued alongside included.
+// Unknown tokens and tokens of other clients are ignored, so the caller
+// learns nothing about them.
+func (s *Service) Revoke(caller *Caller, token, hint string) error {
+	if hint == TokenTypeHintRefreshToken {
+		if revoked, err := s.revokeRefreshToken(caller, token); revoked || err != nil {
+			return err
+		}
+		_, err := s.revokeAccessToken(caller, token)
+		return err
+	}
+
+	if revoked, err := s.revokeAccessToken(caller, token); revoked || err != nil {
+		return err
+	}
+	_, err := s.revokeRefreshToken(caller, token)
+	return err
+}
+
+func (s *Service) revokeAccessToken(caller *Caller, token string) (bool, error) {
+	claims, err := s.Auth.Verifier().Verify(token)
+	if err != nil || claims.ClientID == "" || claims.ClientID != caller.ClientID {
+		return false, nil
+	}
+
+	userID, err := utils.ConvertStringToUUID(claims.UserID)
+	if err != nil || claims.ExpiresAt == nil {
+		return false, nil
+	}
+
+	if err := s.Auth.DenyAccessToken(claims.ID, userID, claims.ExpiresAt.Time); err != nil {
+		return false, err
+	}
+	log.Printf("access token %s revoked by client %s", claims.ID, caller.ClientID)
+	return true, nil
+}
+
+func (s *Service) revokeRefreshToken(caller *Caller, token string) (bool, error) {
+	record, err := s.Auth.FindRefreshToken(token)
+	if err != nil || record.ClientID == "" || record.ClientID != caller.ClientID {
+		return false, nil
+	}
+
+	if err := s.Auth.RevokeFamily(record.FamilyID); err != nil {
+		return false, err
+	}
+	log.Printf("session %s revoked by client %s", record.FamilyID, caller.ClientID)
+	return true, nil
+}
@@ -0,0 +1,92 @@
+package oauth
+
+import (
+	"test-task/internal/modules/oauth/models"
+	"test-task/pkg/utils"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+)
+
+const defaultLoginSessionTTL = 12 * time.Hour
+
+// StartLoginSession remembers that the user just signed in at the
+// authorization endpoint and returns the token for the browser cookie.
+func (s *Service) StartLoginSession(userID uuid.UUID) (string, *models.LoginSession, error) {
+	token, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	ttl := s.Config.LoginSessionTTL
+	if ttl <= 0 {
+		ttl = defaultLoginSessionTTL
+	}
+
+	now := time.Now()
+	session := &models.LoginSession{
+		TokenHash:       utils.HashToken(token),
+		UserID:          userID,
+		AuthenticatedAt: now,
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(ttl),
+	}
+	if err := s.Handler.DB.Create(session).Error; err != nil {
+		return "", nil, err
+	}
+
+	return token, session, nil
+}
+
+// LoginSession returns the live login session of a cookie, or nil.
+func (s *Service) LoginSession(token string) *models.LoginSession {
+	if token == "" {
+		return nil
+	}
+
+	var session models.LoginSession
+	err := s.Handler.DB.
+		Where("token_hash = ? AND expires_at > ?", utils.HashToken(token), time.Now()).
+		First(&session).Error
+	if err != nil {
+		return nil
+	}
+	return &session
+}
+
+// HasConsent reports whether the user already approved every scope for the
+// client.
+func (s *Service) HasConsent(userID uuid.UUID, clientID, scope string) bool {
+	var consent models.Consent
+	if err := s.Handler.DB.Where("user_id = ? AND client_id = ?", userID, clientID).First(&consent).Error; err != nil {
+		return false
+	}
+
+	granted := utils.ParseScope(consent.Scope)
+	for _, value := range utils.ParseScope(scope) {
+		if !utils.ContainsScope(granted, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// SaveConsent adds scope to what the user approved for the client.
+func (s *Service) SaveConsent(userID uuid.UUID, clientID, scope string) error {
+	var existing models.Consent
+	s.Handler.DB.Where("user_id = ? AND client_id = ?", userID, clientID).First(&existing)
+
+	now := time.Now()
+	consent := &models.Consent{
+		UserID:    userID,
+		ClientID:  clientID,
+		Scope:     utils.FormatScope(append(utils.ParseScope(existing.Scope), utils.ParseScope(scope)...)),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	return s.Handler.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "client_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"scope", "updated_at"}),
+	}).Create(consent).Error
+}
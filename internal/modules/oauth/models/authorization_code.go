@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuthorizationCode is a one-time code handed to a client through its
+// redirect URI. Only its hash is stored. SessionID records the session the
+// code was redeemed for, so a replayed code can take that session down.
+type AuthorizationCode struct {
+	CodeHash      string     `gorm:"size:255;primaryKey" json:"-"`
+	ClientID      string     `gorm:"size:64;index" json:"client_id"`
+	UserID        uuid.UUID  `gorm:"type:uuid;index" json:"user_id"`
+	RedirectURI   string     `gorm:"size:2048" json:"redirect_uri"`
+	Scope         string     `gorm:"size:1024" json:"scope"`
+	CodeChallenge string     `gorm:"size:128" json:"-"`
+	Nonce         string     `gorm:"size:255" json:"-"`
+	AuthTime      time.Time  `json:"auth_time"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	UsedAt        *time.Time `json:"used_at,omitempty"`
+	SessionID     *uuid.UUID `gorm:"type:uuid" json:"session_id,omitempty"`
+}
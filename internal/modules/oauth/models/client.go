@@ -0,0 +1,52 @@
+package models
+
+import (
+	"time"
+)
+
+// DefaultGrantTypes are the grants of clients that did not ask for others,
+// including those registered before grant types were recorded.
+var DefaultGrantTypes = []string{"authorization_code", "refresh_token"}
+
+// Client is an application registered to obtain tokens on behalf of users.
+// Public clients, such as mobile and single page apps, cannot keep a secret
+// and authenticate with PKCE alone.
+type Client struct {
+	ID           string     `gorm:"size:64;primaryKey" json:"client_id"`
+	Name         string     `gorm:"size:255" json:"name"`
+	SecretHash   string     `gorm:"size:255" json:"-"`
+	Public       bool       `json:"public"`
+	RedirectURIs StringList `gorm:"type:text" json:"redirect_uris"`
+	GrantTypes   StringList `gorm:"type:text" json:"grant_types"`
+	// Scope lists the scopes the client may request, space separated
+	Scope string `gorm:"size:1024" json:"scope"`
+	// Token lifetimes in seconds, zero keeps the service defaults
+	AccessTokenTTLSeconds  int `json:"access_token_ttl"`
+	RefreshTokenTTLSeconds int `json:"refresh_token_ttl"`
+	// RequireDPoP makes the client send a DPoP proof with every token request,
+	// so all its tokens are bound to a key it holds
+	RequireDPoP bool `json:"dpop_bound_access_tokens"`
+	// IPBindingMode overrides IP_BINDING_MODE for the client's sessions,
+	// empty keeps the service default
+	IPBindingMode string `gorm:"size:16" json:"ip_binding_mode,omitempty"`
+	// RegisteredBy names the admin or registration credential that created
+	// the client
+	RegisteredBy string    `gorm:"size:255" json:"registered_by,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func (c *Client) AllowsGrant(grantType string) bool {
+	if len(c.GrantTypes) == 0 {
+		return StringList(DefaultGrantTypes).Contains(grantType)
+	}
+	return c.GrantTypes.Contains(grantType)
+}
+
+func (c *Client) AccessTokenTTL() time.Duration {
+	return time.Duration(c.AccessTokenTTLSeconds) * time.Second
+}
+
+func (c *Client) RefreshTokenTTL() time.Duration {
+	return time.Duration(c.RefreshTokenTTLSeconds) * time.Second
+}
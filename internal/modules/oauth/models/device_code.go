@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeviceCode is a pending device authorization, RFC 8628. The device polls
+// with the device code while the user approves the short user code in a
+// browser. Only hashes of both codes are stored.
+type DeviceCode struct {
+	DeviceCodeHash string     `gorm:"size:255;primaryKey" json:"-"`
+	UserCodeHash   string     `gorm:"size:255;uniqueIndex" json:"-"`
+	ClientID       string     `gorm:"size:64;index" json:"client_id"`
+	Scope          string     `gorm:"size:1024" json:"scope"`
+	PollInterval   int        `json:"poll_interval"`
+	UserID         *uuid.UUID `gorm:"type:uuid;index" json:"user_id,omitempty"`
+	AuthTime       *time.Time `json:"auth_time,omitempty"`
+	ApprovedAt     *time.Time `json:"approved_at,omitempty"`
+	DeniedAt       *time.Time `json:"denied_at,omitempty"`
+	LastPolledAt   *time.Time `json:"last_polled_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	UsedAt         *time.Time `json:"used_at,omitempty"`
+	SessionID      *uuid.UUID `gorm:"type:uuid" json:"session_id,omitempty"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LoginSession remembers that a browser signed in at the authorization
+// endpoint, so later authorization requests can skip the password prompt.
+// The cookie carries the token, only its hash is stored.
+type LoginSession struct {
+	TokenHash       string    `gorm:"size:255;primaryKey" json:"-"`
+	UserID          uuid.UUID `gorm:"type:uuid;index" json:"user_id"`
+	AuthenticatedAt time.Time `json:"authenticated_at"`
+	CreatedAt       time.Time `json:"created_at"`
+	ExpiresAt       time.Time `json:"expires_at"`
+}
+
+// Consent records the scopes a user approved for a client.
+type Consent struct {
+	UserID    uuid.UUID `gorm:"type:uuid;primaryKey" json:"user_id"`
+	ClientID  string    `gorm:"size:64;primaryKey" json:"client_id"`
+	Scope     string    `gorm:"size:1024" json:"scope"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
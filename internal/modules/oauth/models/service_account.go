@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ServiceAccount is a non-human principal that obtains access tokens with
+// the client_credentials grant. Owner and Team say who to contact about it.
+// Permissions are set by admins and kept apart from Scope, so a scope value
+// never grants a permission.
+type ServiceAccount struct {
+	ID          uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	ClientID    string     `gorm:"size:64;uniqueIndex" json:"client_id"`
+	Name        string     `gorm:"size:255" json:"name"`
+	Description string     `gorm:"size:1024" json:"description"`
+	Owner       string     `gorm:"size:255" json:"owner"`
+	Team        string     `gorm:"size:255" json:"team"`
+	Scope       string     `gorm:"size:1024" json:"scope"`
+	Permissions StringList `gorm:"type:text" json:"permissions"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	DisabledAt  *time.Time `json:"disabled_at,omitempty"`
+}
+
+// ServiceAccountSecret is one of the secrets of a service account. Rotating
+// adds a secret and lets the previous one expire after an overlap, so at
+// most two are valid at a time.
+type ServiceAccountSecret struct {
+	ID               uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	ServiceAccountID uuid.UUID  `gorm:"type:uuid;index" json:"service_account_id"`
+	SecretHash       string     `gorm:"size:255;uniqueIndex" json:"-"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+}
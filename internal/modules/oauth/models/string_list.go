@@ -0,0 +1,43 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+)
+
+// StringList stores a list of strings as a JSON array.
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal([]string(l))
+	return string(data), err
+}
+
+func (l *StringList) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return errors.New("unsupported type for StringList")
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+func (l StringList) Contains(value string) bool {
+	for _, candidate := range l {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package oauth
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	authmodels "test-task/internal/modules/auth/models"
+	"test-task/pkg/utils"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ScopeOpenID = "openid"
+	ScopeEmail  = "email"
+
+	// every sign-in is currently a password sign-in, RFC 8176
+	amrPassword = "pwd"
+)
+
+var validPrompts = []string{"none", "login", "consent", "select_account"}
+
+// Issuer is the issuer of ID tokens and of the discovery document. OpenID
+// Connect requires it to be the URL the discovery document is served from,
+// so it is PUBLIC_URL rather than JWT_ISSUER, which access tokens keep.
+func (s *Service) Issuer() string {
+	return strings.TrimSuffix(s.Config.PublicURL, "/")
+}
+
+// IssuesIDTokens reports whether ID tokens can be issued: PUBLIC_URL names the
+// issuer, and the active signing key is asymmetric, as clients verify ID
+// tokens against the JWKS, which never holds shared secrets.
+func (s *Service) IssuesIDTokens() bool {
+	return s.openIDUnavailable() == nil
+}
+
+func (s *Service) openIDUnavailable() *Error {
+	if s.Issuer() == "" {
+		return newError("invalid_scope", "openid needs PUBLIC_URL, the issuer of ID tokens, to be set")
+	}
+	key, err := s.Auth.Keys.SigningKey()
+	if err != nil || key.Symmetric() {
+		return newError("invalid_scope", "openid needs an asymmetric signing key, clients cannot verify ID tokens signed with a shared secret")
+	}
+	return nil
+}
+
+// checkOpenIDScope refuses the openid scope while no ID token could be issued.
+func (s *Service) checkOpenIDScope(scope string) *Error {
+	if utils.ContainsScope(utils.ParseScope(scope), ScopeOpenID) {
+		return s.openIDUnavailable()
+	}
+	return nil
+}
+
+// HasPrompt reports whether the request asked for the given prompt value.
+func (r AuthorizationRequest) HasPrompt(prompt string) bool {
+	return utils.ContainsScope(strings.Fields(r.Prompt), prompt)
+}
+
+// MaxAge returns the max_age of the request and whether it was given.
+func (r AuthorizationRequest) MaxAge() (time.Duration, bool) {
+	if r.MaxAgeSeconds == "" {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(r.MaxAgeSeconds)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// validateOIDCParameters checks prompt and max_age.
+func validateOIDCParameters(request AuthorizationRequest) *Error {
+	prompts := strings.Fields(request.Prompt)
+	for _, prompt := range prompts {
+		if !utils.ContainsScope(validPrompts, prompt) {
+			return newError("invalid_request", "unsupported prompt "+prompt)
+		}
+	}
+	if request.HasPrompt("none") && len(prompts) > 1 {
+		return newError("invalid_request", "prompt none cannot be combined with other values")
+	}
+
+	if request.MaxAgeSeconds != "" {
+		if _, ok := request.MaxAge(); !ok {
+			return newError("invalid_request", "max_age must be a non-negative number of seconds")
+		}
+	}
+	return nil
+}
+
+// IssueIDToken signs the ID token for a session opened with the openid
+// scope. The nonce is only known when the session was just opened from an
+// authorization code.
+func (s *Service) IssueIDToken(session *authmodels.Token, nonce string) (string, error) {
+	user, err := s.Auth.GetUserByID(session.UserID)
+	if err != nil {
+		return "", err
+	}
+
+	params := utils.IDTokenParams{
+		Subject:   user.ID.String(),
+		ClientID:  session.ClientID,
+		Issuer:    s.Issuer(),
+		Nonce:     nonce,
+		AuthTime:  session.AuthenticatedAt,
+		AMR:       []string{amrPassword},
+		SessionID: session.FamilyID.String(),
+	}
+	if utils.ContainsScope(utils.ParseScope(session.Scope), ScopeEmail) {
+		params.Email = user.Email
+		params.EmailVerified = user.EmailVerifiedAt != nil
+	}
+
+	return utils.GenerateIDToken(params, s.Auth.Keys)
+}
+
+// UserInfo returns the claims about the user the scopes allow.
+func (s *Service) UserInfo(userID uuid.UUID, scopes []string) (map[string]interface{}, error) {
+	user, err := s.Auth.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{"sub": user.ID.String()}
+	if utils.ContainsScope(scopes, ScopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerifiedAt != nil
+	}
+	return claims, nil
+}
+
+// Discovery builds the OpenID Provider metadata. apiURL is the public URL of
+// the API prefix the OAuth endpoints live under. Only algorithms of keys in
+// the JWKS are advertised, and openid only while ID tokens can be issued.
+func (s *Service) Discovery(baseURL, apiURL string) map[string]interface{} {
+	issuer := s.Issuer()
+	if issuer == "" {
+		issuer = baseURL
+	}
+
+	algorithms := []string{}
+	for _, key := range s.Auth.Keys.PublishedKeys().Keys {
+		if !utils.ContainsScope(algorithms, key.Algorithm) {
+			algorithms = append(algorithms, key.Algorithm)
+		}
+	}
+	sort.Strings(algorithms)
+
+	scopes := s.Config.UserScopes
+	if !s.IssuesIDTokens() {
+		scopes = []string{}
+		for _, scope := range s.Config.UserScopes {
+			if scope != ScopeOpenID {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	metadata := map[string]interface{}{
+		"issuer":                                        issuer,
+		"authorization_endpoint":                        apiURL + "/oauth/authorize",
+		"token_endpoint":                                apiURL + "/oauth/token",
+		"userinfo_endpoint":                             apiURL + "/oauth/userinfo",
+		"introspection_endpoint":                        apiURL + "/oauth/introspect",
+		"revocation_endpoint":                           apiURL + "/oauth/revoke",
+		"jwks_uri":                                      baseURL + "/.well-known/jwks.json",
+		"scopes_supported":                              scopes,
+		"response_types_supported":                      []string{"code"},
+		"response_modes_supported":                      []string{"query"},
+		"grant_types_supported":                         []string{"authorization_code", GrantTypeDeviceCode, "refresh_token", "client_credentials", GrantTypeTokenExchange},
+		"subject_types_supported":                       []string{"public"},
+		"id_token_signing_alg_values_supported":         algorithms,
+		"token_endpoint_auth_methods_supported":         []string{"client_secret_basic", "client_secret_post", "none"},
+		"introspection_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"revocation_endpoint_auth_methods_supported":    []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":              []string{utils.PKCEMethodS256},
+		"prompt_values_supported":                       validPrompts,
+		"dpop_signing_alg_values_supported":             utils.DPoPAlgorithms,
+		"claims_supported":                              []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "amr", "sid", "email", "email_verified"},
+	}
+	if len(s.Config.RegistrationCredentials()) > 0 {
+		metadata["registration_endpoint"] = apiURL + "/oauth/register"
+	}
+	return metadata
+}
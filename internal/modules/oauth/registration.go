@@ -0,0 +1,141 @@
+package oauth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"test-task/pkg/utils"
+)
+
+// registrableGrantTypes are the grants a self-registered client may ask for.
+// Token exchange lets a client act for users and stays with the admins.
+var registrableGrantTypes = []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken, GrantTypeDeviceCode}
+
+// RegistrationRequest is the client metadata of RFC 7591 section 2.
+type RegistrationRequest struct {
+	RedirectURIs            []string `json:"redirect_uris"`
+	ClientName              string   `json:"client_name"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	Scope                   string   `json:"scope"`
+	DPoPBoundAccessTokens   bool     `json:"dpop_bound_access_tokens"`
+}
+
+// RegistrationResponse is the client information response of RFC 7591
+// section 3.2.1.
+type RegistrationResponse struct {
+	ClientID                string   `json:"client_id"`
+	ClientSecret            string   `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64    `json:"client_id_issued_at"`
+	ClientSecretExpiresAt   int64    `json:"client_secret_expires_at"`
+	ClientName              string   `json:"client_name"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	Scope                   string   `json:"scope"`
+	DPoPBoundAccessTokens   bool     `json:"dpop_bound_access_tokens"`
+}
+
+// RegistrationCredential returns the name of the initial access token, or
+// false when it is not one of the configured tokens.
+func (s *Service) RegistrationCredential(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	for key, name := range s.Config.RegistrationCredentials() {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// RegisterClient registers a client on behalf of the holder of an initial
+// access token. Self-registered clients are limited to the user scopes and
+// to grants that need the user's approval.
+func (s *Service) RegisterClient(request RegistrationRequest, registeredBy string) (*RegistrationResponse, error) {
+	authMethod := request.TokenEndpointAuthMethod
+	switch authMethod {
+	case "":
+		authMethod = "client_secret_basic"
+	case "none", "client_secret_basic", "client_secret_post":
+	default:
+		return nil, newError("invalid_client_metadata", "unsupported token_endpoint_auth_method")
+	}
+
+	grantTypes := request.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = []string{GrantTypeAuthorizationCode}
+	}
+	for _, grantType := range grantTypes {
+		if !utils.ContainsScope(registrableGrantTypes, grantType) {
+			return nil, newError("invalid_client_metadata", "grant type "+grantType+" cannot be registered")
+		}
+	}
+
+	responseTypes := []string{}
+	if utils.ContainsScope(grantTypes, GrantTypeAuthorizationCode) {
+		responseTypes = []string{"code"}
+	}
+	if len(request.ResponseTypes) > 0 && !equalStrings(request.ResponseTypes, responseTypes) {
+		return nil, newError("invalid_client_metadata", "response_types must match the grant types")
+	}
+
+	for _, uri := range request.RedirectURIs {
+		if err := ValidateRedirectURI(uri); err != nil {
+			return nil, newError("invalid_redirect_uri", err.Error())
+		}
+	}
+
+	scope := request.Scope
+	if scope != "" {
+		var err error
+		if scope, err = utils.NarrowScope(scope, s.Config.UserScopes); err != nil {
+			return nil, newError("invalid_client_metadata", err.Error())
+		}
+	}
+
+	client, secret, err := s.CreateClient(ClientMetadata{
+		Name:         request.ClientName,
+		RedirectURIs: request.RedirectURIs,
+		GrantTypes:   grantTypes,
+		Scope:        scope,
+		Public:       authMethod == "none",
+		RequireDPoP:  request.DPoPBoundAccessTokens,
+	}, "registration:"+registeredBy)
+	if err != nil {
+		if errors.Is(err, ErrInvalidRedirectURIs) {
+			return nil, newError("invalid_redirect_uri", err.Error())
+		}
+		if isClientMetadataError(err) {
+			return nil, newError("invalid_client_metadata", err.Error())
+		}
+		return nil, err
+	}
+
+	return &RegistrationResponse{
+		ClientID:                client.ID,
+		ClientSecret:            secret,
+		ClientIDIssuedAt:        client.CreatedAt.Unix(),
+		ClientName:              client.Name,
+		RedirectURIs:            client.RedirectURIs,
+		GrantTypes:              client.GrantTypes,
+		ResponseTypes:           responseTypes,
+		TokenEndpointAuthMethod: authMethod,
+		Scope:                   client.Scope,
+		DPoPBoundAccessTokens:   client.RequireDPoP,
+	}, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
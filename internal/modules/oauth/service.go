@@ -0,0 +1,70 @@
+package oauth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"test-task/internal/config"
+	db "test-task/internal/database"
+	"test-task/internal/modules/auth"
+	"test-task/pkg/utils"
+)
+
+type Service struct {
+	Handler db.DBHandler
+	Config  *config.Config
+	Auth    *auth.Service
+
+	userCodes *userCodeLimiter
+}
+
+func InitOAuthService(handler db.DBHandler, cfg *config.Config, authService *auth.Service) (*Service, error) {
+	if cfg.PublicURL != "" {
+		if err := utils.ValidateIssuerURL(strings.TrimSuffix(cfg.PublicURL, "/")); err != nil {
+			return nil, fmt.Errorf("PUBLIC_URL %q cannot be the OpenID Connect issuer: %w", cfg.PublicURL, err)
+		}
+	}
+
+	return &Service{
+		Handler: handler,
+		Config:  cfg,
+		Auth:    authService,
+
+		userCodes: &userCodeLimiter{},
+	}, nil
+}
+
+// Error is an OAuth error response, RFC 6749 section 5.2.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// Status is the HTTP status the token endpoint answers the error with.
+func (e *Error) Status() int {
+	switch e.Code {
+	case "invalid_client":
+		return http.StatusUnauthorized
+	case "server_error":
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func newError(code, description string) *Error {
+	return &Error{Code: code, Description: description}
+}
+
+var (
+	errInvalidClient = newError("invalid_client", "client authentication failed")
+	errInvalidGrant  = newError("invalid_grant", "the grant is invalid, expired or was already used")
+	errServerError   = newError("server_error", "")
+)
@@ -0,0 +1,248 @@
+package oauth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"test-task/internal/modules/oauth/models"
+	"test-task/pkg/utils"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const defaultSecretOverlap = 24 * time.Hour
+
+var (
+	ErrServiceAccountNotFound = errors.New("service account not found")
+	ErrInvalidServiceAccount  = errors.New("service account name and owner are required")
+	ErrUnknownPermission      = errors.New("unknown permission")
+)
+
+// CreateServiceAccount registers a service account and returns its first
+// secret, which is not stored in plain text and cannot be shown again. The
+// caller makes sure the creator holds the permissions given to the account.
+func (s *Service) CreateServiceAccount(account models.ServiceAccount) (*models.ServiceAccount, string, error) {
+	if strings.TrimSpace(account.Name) == "" || strings.TrimSpace(account.Owner) == "" {
+		return nil, "", ErrInvalidServiceAccount
+	}
+
+	known, err := s.Auth.PermissionNames()
+	if err != nil {
+		return nil, "", err
+	}
+	permissions := models.StringList{}
+	for _, permission := range account.Permissions {
+		if !utils.ContainsScope(known, permission) {
+			return nil, "", fmt.Errorf("%w %q", ErrUnknownPermission, permission)
+		}
+		if !permissions.Contains(permission) {
+			permissions = append(permissions, permission)
+		}
+	}
+	account.Permissions = permissions
+
+	now := time.Now()
+	account.ID = uuid.New()
+	account.ClientID = "sa-" + uuid.NewString()
+	account.Scope = utils.FormatScope(utils.ParseScope(account.Scope))
+	account.CreatedAt = now
+	account.UpdatedAt = now
+	account.LastUsedAt = nil
+	account.DisabledAt = nil
+
+	var secret string
+	err = s.Handler.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&account).Error; err != nil {
+			return err
+		}
+
+		var err error
+		secret, err = addServiceAccountSecret(tx, account.ID, now)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &account, secret, nil
+}
+
+func (s *Service) ListServiceAccounts() ([]models.ServiceAccount, error) {
+	var accounts []models.ServiceAccount
+	err := s.Handler.DB.Order("created_at DESC").Find(&accounts).Error
+	return accounts, err
+}
+
+func (s *Service) GetServiceAccount(id uuid.UUID) (*models.ServiceAccount, error) {
+	var account models.ServiceAccount
+	if err := s.Handler.DB.Where("id = ?", id).First(&account).Error; err != nil {
+		return nil, ErrServiceAccountNotFound
+	}
+	return &account, nil
+}
+
+// RotateServiceAccountSecret adds a new secret. The newest of the previous
+// secrets keeps working for the configured overlap, older ones stop at once.
+func (s *Service) RotateServiceAccountSecret(id uuid.UUID) (string, *time.Time, error) {
+	if _, err := s.GetServiceAccount(id); err != nil {
+		return "", nil, err
+	}
+
+	overlap := s.Config.ServiceAccountSecretOverlap
+	if overlap <= 0 {
+		overlap = defaultSecretOverlap
+	}
+
+	now := time.Now()
+	previousExpiresAt := now.Add(overlap)
+
+	var secret string
+	err := s.Handler.DB.Transaction(func(tx *gorm.DB) error {
+		var valid []models.ServiceAccountSecret
+		err := tx.Where("service_account_id = ? AND (expires_at IS NULL OR expires_at > ?)", id, now).
+			Order("created_at DESC").
+			Find(&valid).Error
+		if err != nil {
+			return err
+		}
+
+		for i, previous := range valid {
+			expiresAt := now
+			if i == 0 {
+				expiresAt = previousExpiresAt
+			}
+			if previous.ExpiresAt != nil && previous.ExpiresAt.Before(expiresAt) {
+				continue
+			}
+			if err := tx.Model(&previous).Update("expires_at", expiresAt).Error; err != nil {
+				return err
+			}
+		}
+
+		secret, err = addServiceAccountSecret(tx, id, now)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return secret, &previousExpiresAt, nil
+}
+
+// SetServiceAccountDisabled stops or resumes token issuance for a service
+// account. Tokens already issued run out on their own.
+func (s *Service) SetServiceAccountDisabled(id uuid.UUID, disabled bool) (*models.ServiceAccount, error) {
+	account, err := s.GetServiceAccount(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var disabledAt *time.Time
+	if disabled {
+		now := time.Now()
+		disabledAt = &now
+	}
+	account.DisabledAt = disabledAt
+	account.UpdatedAt = time.Now()
+
+	if err := s.Handler.DB.Save(account).Error; err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// AuthenticateServiceAccount checks the credentials presented with the
+// client_credentials grant against every currently valid secret.
+func (s *Service) AuthenticateServiceAccount(clientID, secret string) (*models.ServiceAccount, error) {
+	if clientID == "" || secret == "" {
+		return nil, errInvalidClient
+	}
+
+	var account models.ServiceAccount
+	if err := s.Handler.DB.Where("client_id = ?", clientID).First(&account).Error; err != nil {
+		return nil, errInvalidClient
+	}
+	if account.DisabledAt != nil {
+		return nil, errInvalidClient
+	}
+
+	var secrets []models.ServiceAccountSecret
+	err := s.Handler.DB.Where("service_account_id = ? AND (expires_at IS NULL OR expires_at > ?)", account.ID, time.Now()).
+		Find(&secrets).Error
+	if err != nil {
+		return nil, err
+	}
+
+	presented := []byte(utils.HashToken(secret))
+	for _, candidate := range secrets {
+		if subtle.ConstantTimeCompare(presented, []byte(candidate.SecretHash)) == 1 {
+			return &account, nil
+		}
+	}
+	return nil, errInvalidClient
+}
+
+// IssueServiceAccountToken mints an access token for a service account. The
+// account may request its scope and its permissions; like for users, only the
+// permissions the granted scope names are embedded.
+func (s *Service) IssueServiceAccountToken(account *models.ServiceAccount, requestedScope, ipAddress string) (string, string, error) {
+	allowed := append(utils.ParseScope(account.Scope), account.Permissions...)
+	scope, err := utils.NarrowScope(requestedScope, allowed)
+	if err != nil {
+		return "", "", newError("invalid_scope", err.Error())
+	}
+
+	var permissions []string
+	for _, value := range utils.ParseScope(scope) {
+		if account.Permissions.Contains(value) {
+			permissions = append(permissions, value)
+		}
+	}
+
+	audience, err := s.Auth.ResolveAudience("")
+	if err != nil {
+		return "", "", err
+	}
+
+	accessToken, err := utils.GenerateAccessToken(utils.AccessTokenParams{
+		UserID:      account.ID.String(),
+		ClientID:    account.ClientID,
+		Kind:        utils.KindServiceAccount,
+		IPAddress:   ipAddress,
+		Scope:       scope,
+		Permissions: permissions,
+		Issuer:      s.Config.JWTIssuer,
+		Audience:    audience,
+	}, s.Auth.Keys)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := s.Handler.DB.Model(account).Update("last_used_at", time.Now()).Error; err != nil {
+		log.Printf("failed to record use of service account %s: %v", account.ID, err)
+	}
+
+	return accessToken, scope, nil
+}
+
+func addServiceAccountSecret(tx *gorm.DB, accountID uuid.UUID, now time.Time) (string, error) {
+	secret, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	record := &models.ServiceAccountSecret{
+		ID:               uuid.New(),
+		ServiceAccountID: accountID,
+		SecretHash:       utils.HashToken(secret),
+		CreatedAt:        now,
+	}
+	if err := tx.Create(record).Error; err != nil {
+		return "", err
+	}
+	return secret, nil
+}
@@ -0,0 +1,89 @@
+package oauth
+
+import "html/template"
+
+// authorizePage signs the user in and asks them to approve the client in one
+// step, or only asks for approval when Email names the signed in user. The
+// authorization request travels along in hidden fields.
+var authorizePage = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in to {{.Client.Name}}</title>
+</head>
+<body>
+<h1>{{.Client.Name}} wants to access your account</h1>
+{{if .Scopes}}<p>It is asking for:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>{{end}}
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post">
+<input type="hidden" name="client_id" value="{{.Request.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">
+<input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+<input type="hidden" name="scope" value="{{.Request.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+<input type="hidden" name="nonce" value="{{.Request.Nonce}}">
+<input type="hidden" name="prompt" value="{{.Request.Prompt}}">
+<input type="hidden" name="max_age" value="{{.Request.MaxAgeSeconds}}">
+{{if .Email}}<p>Signed in as {{.Email}}</p>
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+{{else}}<label>Email <input type="email" name="email" autocomplete="username" required></label>
+<label>Password <input type="password" name="password" autocomplete="current-password" required></label>
+{{end}}<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Authorization failed</title>
+</head>
+<body>
+<h1>Authorization failed</h1>
+<p>{{.Description}}</p>
+</body>
+</html>
+`))
+
+// devicePage asks for the user code shown on the device and, once it is
+// known, for approval of the client that started the device authorization.
+var devicePage = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Connect a device</title>
+</head>
+<body>
+{{if .Done}}<h1>{{.Done}}</h1>
+<p>You can close this window and return to your device.</p>
+{{else if .Client}}<h1>{{.Client.Name}} wants to access your account</h1>
+<p>Only continue if {{.UserCode}} is the code shown on your device.</p>
+{{if .Scopes}}<p>It is asking for:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>{{end}}
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post">
+<input type="hidden" name="user_code" value="{{.UserCode}}">
+{{if .Email}}<p>Signed in as {{.Email}}</p>
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+{{else}}<label>Email <input type="email" name="email" autocomplete="username" required></label>
+<label>Password <input type="password" name="password" autocomplete="current-password" required></label>
+{{end}}<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+{{else}}<h1>Connect a device</h1>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="get">
+<label>Code shown on your device <input type="text" name="user_code" autocomplete="off" autocapitalize="characters" required></label>
+<button type="submit">Continue</button>
+</form>
+{{end}}</body>
+</html>
+`))
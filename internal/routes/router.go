@@ -1,7 +1,10 @@
 package routes
 
 import (
+	"test-task/internal/middleware"
 	"test-task/internal/modules/auth"
+	"test-task/internal/modules/auth/models"
+	"test-task/internal/modules/oauth"
 
 	"github.com/gin-gonic/gin"
 )
@@ -10,6 +13,13 @@ type AppRouter struct {
 	Prefix  string
 	Version string
 	Routes  *gin.RouterGroup
+	// Root serves well-known endpoints that must live outside the API prefix
+	Root *gin.Engine
+	// Authenticate requires a valid access token and RequireAdmin an admin
+	// API key or a user granted the permission. Both are available once the
+	// auth routes are registered.
+	Authenticate gin.HandlerFunc
+	RequireAdmin func(permission string) gin.HandlerFunc
 }
 
 func NewAppRouter(engine *gin.Engine, prefix string, version string) *AppRouter {
@@ -18,14 +28,85 @@ func NewAppRouter(engine *gin.Engine, prefix string, version string) *AppRouter
 		Prefix:  prefix,
 		Version: version,
 		Routes:  router,
+		Root:    engine,
 	}
 }
 
 func (r *AppRouter) RegisterAuthRoutes(handler *auth.Handler) {
+	r.Authenticate = handler.Authenticator()
+	r.RequireAdmin = func(permission string) gin.HandlerFunc {
+		return middleware.RequireAdmin(handler.Config, handler.AuthOptions(), permission)
+	}
 	router := r.Routes.Group("/auth")
 
 	router.POST("/login", handler.LoginUserHandler)
 	router.POST("/signup", handler.RegisterUserHandler)
-	router.POST("/issue-tokens/:id", handler.IssueTokensHandler)
+	router.POST("/verify-email", handler.VerifyEmailHandler)
+	router.POST("/verify-email/resend", handler.ResendVerificationHandler)
+	router.POST("/password/forgot", handler.ForgotPasswordHandler)
+	router.POST("/password/reset", handler.ResetPasswordHandler)
+	router.POST("/password/change", r.Authenticate, handler.ChangePasswordHandler)
+	router.POST("/issue-tokens/:id", r.RequireAdmin(models.PermissionTokensIssue), handler.IssueTokensHandler)
 	router.POST("/refresh-tokens", handler.RefreshTokensHandler)
+	router.POST("/logout", r.Authenticate, handler.LogoutHandler)
+	router.POST("/logout-all", r.Authenticate, handler.LogoutAllHandler)
+	router.GET("/sessions", r.Authenticate, middleware.RequireScope("sessions"), handler.ListSessionsHandler)
+	router.DELETE("/sessions/:id", r.Authenticate, middleware.RequireScope("sessions"), handler.RevokeSessionHandler)
+
+	r.registerAdminRoutes(handler)
+
+	r.Root.GET("/.well-known/jwks.json", handler.JWKSHandler)
+}
+
+func (r *AppRouter) registerAdminRoutes(handler *auth.Handler) {
+	router := r.Routes.Group("/admin")
+
+	keys := router.Group("/keys", r.RequireAdmin(models.PermissionKeysManage))
+	keys.GET("", handler.ListSigningKeysHandler)
+	keys.POST("", handler.GenerateSigningKeyHandler)
+	keys.POST("/:kid/promote", handler.PromoteSigningKeyHandler)
+	keys.POST("/:kid/retire", handler.RetireSigningKeyHandler)
+
+	roles := router.Group("/roles", r.RequireAdmin(models.PermissionRolesManage))
+	roles.GET("", handler.ListRolesHandler)
+	roles.PUT("/:name", handler.SaveRoleHandler)
+
+	users := router.Group("/users")
+	users.GET("/:id", r.RequireAdmin(models.PermissionUsersRead), handler.GetUserHandler)
+	users.GET("/:id/roles", r.RequireAdmin(models.PermissionUsersRead), handler.ListUserRolesHandler)
+	users.POST("/:id/roles", r.RequireAdmin(models.PermissionRolesManage), handler.AssignRoleHandler)
+	users.DELETE("/:id/roles/:role", r.RequireAdmin(models.PermissionRolesManage), handler.RemoveRoleHandler)
+}
+
+func (r *AppRouter) RegisterOAuthRoutes(handler *oauth.Handler) {
+	router := r.Routes.Group("/oauth")
+
+	router.GET("/authorize", handler.AuthorizeHandler)
+	router.POST("/authorize", handler.AuthorizeDecisionHandler)
+	router.POST("/device_authorization", handler.DeviceAuthorizationHandler)
+	router.GET("/device", handler.DeviceHandler)
+	router.POST("/device", handler.DeviceDecisionHandler)
+	router.POST("/token", handler.TokenHandler)
+	router.POST("/introspect", handler.IntrospectHandler)
+	router.POST("/revoke", handler.RevokeHandler)
+	router.POST("/register", handler.RegisterHandler)
+	router.GET("/userinfo", r.Authenticate, middleware.RequireScope(oauth.ScopeOpenID), handler.UserInfoHandler)
+	router.POST("/userinfo", r.Authenticate, middleware.RequireScope(oauth.ScopeOpenID), handler.UserInfoHandler)
+
+	clients := r.Routes.Group("/admin/clients", r.RequireAdmin(models.PermissionClientsManage))
+	clients.GET("", handler.ListClientsHandler)
+	clients.POST("", handler.CreateClientHandler)
+	clients.GET("/:id", handler.GetClientHandler)
+	clients.PUT("/:id", handler.UpdateClientHandler)
+	clients.DELETE("/:id", handler.DeleteClientHandler)
+	clients.POST("/:id/secret", handler.RotateClientSecretHandler)
+
+	accounts := r.Routes.Group("/admin/service-accounts", r.RequireAdmin(models.PermissionServiceAccountsManage))
+	accounts.GET("", handler.ListServiceAccountsHandler)
+	accounts.POST("", handler.CreateServiceAccountHandler)
+	accounts.POST("/:id/secrets", handler.RotateServiceAccountSecretHandler)
+	accounts.POST("/:id/disable", handler.DisableServiceAccountHandler)
+	accounts.POST("/:id/enable", handler.EnableServiceAccountHandler)
+
+	r.Root.GET("/.well-known/openid-configuration", handler.DiscoveryHandler(r.Prefix+r.Version))
 }
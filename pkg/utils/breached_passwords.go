@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BreachedPasswordCorpus looks passwords up in a local copy of the Have I
+// Been Pwned range files, so checks work without network access and no
+// password leaves the machine. Dir holds one file per five hex character
+// SHA-1 prefix, named like the range API path ("21BD1" or "21BD1.txt"), with
+// lines of the remaining 35 characters and a count:
+//
+//	0018A45C4D1DEF81644B54AB7F969B88D65:10
+//
+// Prefixes without a file count as not breached, so a partial corpus works.
+type BreachedPasswordCorpus struct {
+	Dir string
+	// MinCount is how often a password must have been seen to be refused;
+	// values below 1 mean once
+	MinCount int
+}
+
+func (c BreachedPasswordCorpus) Breached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := c.open(prefix)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	minCount := c.MinCount
+	if minCount < 1 {
+		minCount = 1
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		candidate, count, found := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !found || !strings.EqualFold(candidate, suffix) {
+			continue
+		}
+		// padded responses list made up suffixes with a count of 0
+		seen, err := strconv.Atoi(count)
+		return err == nil && seen >= minCount, nil
+	}
+	return false, scanner.Err()
+}
+
+func (c BreachedPasswordCorpus) open(prefix string) (*os.File, error) {
+	for _, name := range []string{prefix, prefix + ".txt", strings.ToLower(prefix), strings.ToLower(prefix) + ".txt"} {
+		file, err := os.Open(filepath.Join(c.Dir, name))
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			return file, err
+		}
+	}
+	return nil, os.ErrNotExist
+}
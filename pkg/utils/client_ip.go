@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Headers a trusted proxy may report the client address in.
+const (
+	HeaderForwarded     = "Forwarded"
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderXRealIP       = "X-Real-IP"
+)
+
+// ParseTrustedProxies parses CIDR ranges. Single addresses are accepted as
+// ranges of one.
+func ParseTrustedProxies(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if !strings.Contains(value, "/") {
+			addr, err := NormalizeIP(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", value)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", value)
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ClientIPResolver finds the address of the client behind the proxies in
+// TrustedProxies. Forwarding headers are only believed when the request came
+// from a trusted proxy, and only Header, the one the proxies set, is read:
+// a header the proxies pass through untouched is whatever the client wrote.
+type ClientIPResolver struct {
+	TrustedProxies []netip.Prefix
+	// Header is X-Forwarded-For, Forwarded or X-Real-IP
+	Header string
+}
+
+// Trusted reports whether addr is one of the trusted proxies.
+func (r ClientIPResolver) Trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range r.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the normalized client address of a request received from
+// remoteAddr, a host:port pair.
+func (r ClientIPResolver) Resolve(remoteAddr string, header http.Header) string {
+	remote, err := NormalizeIP(hostOnly(remoteAddr))
+	if err != nil {
+		return hostOnly(remoteAddr)
+	}
+	if !r.Trusted(remote) {
+		return remote.String()
+	}
+
+	var hops []string
+	switch {
+	case strings.EqualFold(r.Header, HeaderForwarded):
+		hops = forwardedFor(header.Values(HeaderForwarded))
+	case strings.EqualFold(r.Header, HeaderXRealIP):
+		hops = []string{header.Get(HeaderXRealIP)}
+	default:
+		for _, value := range header.Values(HeaderXForwardedFor) {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	}
+
+	// walk back from the nearest hop until one is not a trusted proxy
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := NormalizeIP(hostOnly(hops[i]))
+		if err != nil {
+			// an obfuscated or garbled hop, the last proxy is all we know
+			break
+		}
+		client = addr
+		if !r.Trusted(addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedFor extracts the for= parameters of Forwarded headers, RFC 7239.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(name, "for") {
+					hop = strings.Trim(value, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// hostOnly strips the port and IPv6 brackets from an address.
+func hostOnly(address string) string {
+	address = strings.TrimSpace(address)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+}
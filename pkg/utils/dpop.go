@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	DPoPProofType = "dpop+jwt"
+
+	// DefaultDPoPProofLifetime is how far the iat of a proof may lie from now
+	DefaultDPoPProofLifetime = 5 * time.Minute
+)
+
+// DPoPAlgorithms are the asymmetric algorithms DPoP proofs may be signed
+// with.
+var DPoPAlgorithms = []string{"ES256", "ES384", "ES512", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "EdDSA"}
+
+var (
+	ErrInvalidDPoPProof = errors.New("invalid DPoP proof")
+	ErrDPoPProofReused  = errors.New("DPoP proof was already used")
+)
+
+// Confirmation is the cnf claim of a sender-constrained token. JKT is the
+// RFC 7638 thumbprint of the DPoP key the token is bound to.
+type Confirmation struct {
+	JKT string `json:"jkt"`
+}
+
+// ProofReplayCache remembers DPoP proofs until they expire, so each can be
+// used once.
+type ProofReplayCache interface {
+	// Remember reports false when the proof was seen before.
+	Remember(id string, expiresAt time.Time) (bool, error)
+}
+
+// DPoPClaims are the claims of a DPoP proof, RFC 9449 section 4.2.
+type DPoPClaims struct {
+	HTM string `json:"htm"`
+	HTU string `json:"htu"`
+	// ATH is the hash of the access token the proof is sent with
+	ATH string `json:"ath,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// DPoPVerifier checks DPoP proofs. BaseURL, when set, is the public scheme and
+// host requests are matched against, for services behind a proxy.
+type DPoPVerifier struct {
+	ReplayCache ProofReplayCache
+	BaseURL     string
+	Lifetime    time.Duration
+}
+
+// Verify checks a proof sent with a request to method and requestURL and
+// returns the thumbprint of the key that signed it. accessToken is set when
+// the proof accompanies an access token, which ath must then hash.
+func (v DPoPVerifier) Verify(proof, method, requestURL, accessToken string) (string, error) {
+	var thumbprint string
+	claims := &DPoPClaims{}
+	_, err := jwt.ParseWithClaims(proof, claims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ != DPoPProofType {
+			return nil, errors.New("proof is not a dpop+jwt")
+		}
+
+		jwk, err := proofJWK(token.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		thumbprint = jwk.Thumbprint()
+		return jwk.PublicKey()
+	}, jwt.WithValidMethods(DPoPAlgorithms), jwt.WithoutClaimsValidation())
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidDPoPProof, err)
+	}
+
+	if claims.ID == "" || claims.IssuedAt == nil {
+		return "", fmt.Errorf("%w: jti and iat are required", ErrInvalidDPoPProof)
+	}
+	if claims.HTM != method {
+		return "", fmt.Errorf("%w: htm does not match the request", ErrInvalidDPoPProof)
+	}
+	if normalizeHTU(claims.HTU) == "" || normalizeHTU(claims.HTU) != normalizeHTU(requestURL) {
+		return "", fmt.Errorf("%w: htu does not match the request", ErrInvalidDPoPProof)
+	}
+
+	lifetime := v.Lifetime
+	if lifetime <= 0 {
+		lifetime = DefaultDPoPProofLifetime
+	}
+	age := time.Since(claims.IssuedAt.Time)
+	if age > lifetime || age < -lifetime {
+		return "", fmt.Errorf("%w: iat is too far from now", ErrInvalidDPoPProof)
+	}
+
+	if accessToken != "" && claims.ATH != AccessTokenHash(accessToken) {
+		return "", fmt.Errorf("%w: ath does not match the access token", ErrInvalidDPoPProof)
+	}
+
+	if v.ReplayCache != nil {
+		fresh, err := v.ReplayCache.Remember(HashToken(thumbprint+":"+claims.ID), claims.IssuedAt.Add(lifetime))
+		if err != nil {
+			return "", err
+		}
+		if !fresh {
+			return "", ErrDPoPProofReused
+		}
+	}
+
+	return thumbprint, nil
+}
+
+// RequestURL returns the URL a proof sent with r must name in its htu claim.
+func (v DPoPVerifier) RequestURL(r *http.Request) string {
+	if v.BaseURL != "" {
+		return strings.TrimSuffix(v.BaseURL, "/") + r.URL.EscapedPath()
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.EscapedPath()
+}
+
+// AccessTokenHash is the ath claim of a proof sent with accessToken.
+func AccessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// proofJWK reads the jwk header of a proof, which must be a public key.
+func proofJWK(header interface{}) (JWK, error) {
+	members, ok := header.(map[string]interface{})
+	if !ok {
+		return JWK{}, errors.New("proof has no jwk header")
+	}
+	for _, private := range []string{"d", "p", "q", "dp", "dq", "qi", "k"} {
+		if _, found := members[private]; found {
+			return JWK{}, errors.New("jwk header must not contain a private key")
+		}
+	}
+
+	data, err := json.Marshal(members)
+	if err != nil {
+		return JWK{}, err
+	}
+	var jwk JWK
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return JWK{}, err
+	}
+	return jwk, nil
+}
+
+// normalizeHTU drops the query, fragment and default port of a URL and
+// lowercases its scheme and host, RFC 9449 section 4.3.
+func normalizeHTU(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return ""
+	}
+
+	scheme := strings.ToLower(parsed.Scheme)
+	host := strings.ToLower(parsed.Hostname())
+	port := parsed.Port()
+	if port != "" && !(scheme == "https" && port == "443") && !(scheme == "http" && port == "80") {
+		host += ":" + port
+	}
+	path := parsed.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return scheme + "://" + host + path
+}
@@ -2,9 +2,43 @@ package utils
 
 import (
 	"fmt"
+	"log"
 	"net/smtp"
 )
 
+// Mailer sends plain text emails.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer sends emails through an SMTP server with SendEmail.
+type SMTPMailer struct {
+	From     string
+	Password string
+	Host     string
+	Port     string
+}
+
+func (m SMTPMailer) Send(to, subject, body string) error {
+	return SendEmail(m.From, m.Password, m.Host, m.Port, to, subject, body)
+}
+
+// LogMailer writes emails to the log instead of sending them, for
+// development setups without an SMTP server. Bodies carry live tokens, such
+// as password reset links, so they are only logged with LogBodies.
+type LogMailer struct {
+	LogBodies bool
+}
+
+func (m LogMailer) Send(to, subject, body string) error {
+	if !m.LogBodies {
+		log.Printf("email to %s not sent, SMTP is not configured: %s", to, subject)
+		return nil
+	}
+	log.Printf("email to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
 func SendEmail(from, password, smtpHost, smtpPort, to, subject, body string) error {
 	msg := "From: " + from + "\n" +
 		"To: " + to + "\n" +
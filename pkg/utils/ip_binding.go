@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// IPBindingMode says how closely a session is tied to the address it was
+// opened from.
+type IPBindingMode string
+
+const (
+	// IPBindingStrict requires the exact address the session was opened from
+	IPBindingStrict IPBindingMode = "strict"
+	// IPBindingSameSubnet also accepts addresses in the same subnet, so
+	// carrier NAT and VPN exits that rotate addresses keep users signed in
+	IPBindingSameSubnet IPBindingMode = "same_subnet"
+	// IPBindingWarnOnly reports changed addresses without rejecting them
+	IPBindingWarnOnly IPBindingMode = "warn_only"
+	IPBindingOff      IPBindingMode = "off"
+)
+
+const (
+	DefaultIPv4BindingPrefix = 24
+	DefaultIPv6BindingPrefix = 64
+)
+
+// IPBindingDecision is the outcome of checking an address against a session.
+type IPBindingDecision string
+
+const (
+	IPDecisionMatch      IPBindingDecision = "match"
+	IPDecisionSameSubnet IPBindingDecision = "same_subnet"
+	IPDecisionWarned     IPBindingDecision = "warned"
+	IPDecisionRejected   IPBindingDecision = "rejected"
+	// IPDecisionSkipped means nothing was compared, because binding is off or
+	// the session has no address
+	IPDecisionSkipped IPBindingDecision = "skipped"
+)
+
+func (d IPBindingDecision) Allowed() bool {
+	return d != IPDecisionRejected
+}
+
+// Changed reports whether the address differed from the bound one.
+func (d IPBindingDecision) Changed() bool {
+	return d == IPDecisionSameSubnet || d == IPDecisionWarned || d == IPDecisionRejected
+}
+
+// ParseIPBindingMode accepts the modes by name, case insensitively. An empty
+// string is IPBindingStrict.
+func ParseIPBindingMode(mode string) (IPBindingMode, error) {
+	switch parsed := IPBindingMode(strings.ToLower(strings.TrimSpace(mode))); parsed {
+	case "":
+		return IPBindingStrict, nil
+	case IPBindingStrict, IPBindingSameSubnet, IPBindingWarnOnly, IPBindingOff:
+		return parsed, nil
+	}
+	return "", fmt.Errorf("unknown IP binding mode %q", mode)
+}
+
+// IPBindingPolicy decides whether a session may be used from an address.
+// The prefixes are the subnet sizes IPBindingSameSubnet compares.
+type IPBindingPolicy struct {
+	Mode       IPBindingMode
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+// WithMode returns the policy with another mode, for clients that override
+// it. An empty mode keeps the policy as is.
+func (p IPBindingPolicy) WithMode(mode IPBindingMode) IPBindingPolicy {
+	if mode != "" {
+		p.Mode = mode
+	}
+	return p
+}
+
+// Decide compares the address a session is bound to with the one it is used
+// from. Addresses are normalized first, so an IPv4 address and its
+// IPv4-mapped IPv6 form match.
+func (p IPBindingPolicy) Decide(boundIP, currentIP string) IPBindingDecision {
+	if p.Mode == IPBindingOff || boundIP == "" {
+		return IPDecisionSkipped
+	}
+
+	bound, boundErr := NormalizeIP(boundIP)
+	current, currentErr := NormalizeIP(currentIP)
+	valid := boundErr == nil && currentErr == nil
+	if boundIP == currentIP || (valid && bound == current) {
+		return IPDecisionMatch
+	}
+
+	if p.Mode == IPBindingSameSubnet && valid && p.sameSubnet(bound, current) {
+		return IPDecisionSameSubnet
+	}
+	if p.Mode == IPBindingWarnOnly {
+		return IPDecisionWarned
+	}
+	return IPDecisionRejected
+}
+
+func (p IPBindingPolicy) sameSubnet(a, b netip.Addr) bool {
+	if a.Is4() != b.Is4() {
+		return false
+	}
+
+	bits := p.IPv6Prefix
+	if bits <= 0 || bits > 128 {
+		bits = DefaultIPv6BindingPrefix
+	}
+	if a.Is4() {
+		bits = p.IPv4Prefix
+		if bits <= 0 || bits > 32 {
+			bits = DefaultIPv4BindingPrefix
+		}
+	}
+
+	prefix, err := a.Prefix(bits)
+	return err == nil && prefix.Contains(b)
+}
+
+// NormalizeIP parses an address, unwrapping IPv4-mapped IPv6 addresses and
+// dropping any zone.
+func NormalizeIP(address string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(address))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap().WithZone(""), nil
+}
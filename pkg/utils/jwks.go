@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/big"
+)
+
+// JWK is the public half of a signing key in RFC 7517 form.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set as served from /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+var errSymmetricJWK = errors.New("symmetric keys cannot be published")
+
+// JWK returns the public key as a JWK. It fails for HMAC keys.
+func (k *SigningKey) JWK() (JWK, error) {
+	jwk, err := PublicJWK(k.publicKey)
+	if err != nil {
+		return JWK{}, err
+	}
+
+	jwk.KeyID = k.ID
+	jwk.Use = "sig"
+	jwk.Algorithm = k.Method.Alg()
+	return jwk, nil
+}
+
+// PublicJWK encodes an RSA, ECDSA or Ed25519 public key.
+func PublicJWK(publicKey interface{}) (JWK, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			KeyType: "RSA",
+			N:       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			KeyType: "EC",
+			Curve:   key.Curve.Params().Name,
+			X:       base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+			Y:       base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case ed25519.PublicKey:
+		return JWK{
+			KeyType: "OKP",
+			Curve:   "Ed25519",
+			X:       base64.RawURLEncoding.EncodeToString(key),
+		}, nil
+	case []byte:
+		return JWK{}, errSymmetricJWK
+	}
+	return JWK{}, errors.New("unsupported public key type")
+}
+
+// PublicKey decodes the key a JWK describes, the inverse of PublicJWK.
+func (j JWK) PublicKey() (interface{}, error) {
+	switch j.KeyType {
+	case "RSA":
+		n, err := decodeJWKInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve")
+		}
+		x, err := decodeJWKInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if j.Curve != "Ed25519" {
+			return nil, errors.New("unsupported curve")
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+func decodeJWKInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key member")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// Thumbprint computes the RFC 7638 SHA-256 thumbprint, base64url encoded.
+func (j JWK) Thumbprint() string {
+	// required members only, in lexicographic order, without whitespace
+	var canonical string
+	switch j.KeyType {
+	case "RSA":
+		canonical = `{"e":"` + j.E + `","kty":"RSA","n":"` + j.N + `"}`
+	case "EC":
+		canonical = `{"crv":"` + j.Curve + `","kty":"EC","x":"` + j.X + `","y":"` + j.Y + `"}`
+	case "OKP":
+		canonical = `{"crv":"` + j.Curve + `","kty":"OKP","x":"` + j.X + `"}`
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// PublishedKeys returns the JWKS for the given keys, leaving out shared
+// secrets.
+func PublishedKeys(keys ...*SigningKey) JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range keys {
+		if key.Symmetric() {
+			continue
+		}
+		if jwk, err := key.JWK(); err == nil {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoActiveKey = errors.New("no active signing key")
+
+// KeyRing holds every key access tokens may currently be verified with, each
+// identified by its kid, and the one new tokens are signed with. Keys stop
+// verifying once their retirement time passes.
+type KeyRing struct {
+	mu     sync.RWMutex
+	active string
+	keys   map[string]ringKey
+}
+
+type ringKey struct {
+	key       *SigningKey
+	retiresAt time.Time
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[string]ringKey)}
+}
+
+// Add puts a key on the ring. A zero retiresAt keeps it valid indefinitely.
+func (r *KeyRing) Add(key *SigningKey, retiresAt time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys[key.ID] = ringKey{key: key, retiresAt: retiresAt}
+}
+
+// Activate selects the key new tokens are signed with.
+func (r *KeyRing) Activate(kid string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.keys[kid]; !ok {
+		return ErrUnknownKey
+	}
+	r.active = kid
+	return nil
+}
+
+func (r *KeyRing) SigningKey() (*SigningKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, ok := r.keys[r.active]
+	if !ok {
+		return nil, ErrNoActiveKey
+	}
+	return entry.key, nil
+}
+
+// VerificationKey looks a key up by kid. Tokens without a kid resolve to the
+// key that has none, which is how tokens from before kids existed verify.
+func (r *KeyRing) VerificationKey(kid string) (*SigningKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, ok := r.keys[kid]
+	if !ok || entry.retired(time.Now()) {
+		return nil, ErrUnknownKey
+	}
+	return entry.key, nil
+}
+
+// PublishedKeys returns the JWKS of every key that still verifies.
+func (r *KeyRing) PublishedKeys() JWKS {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	keys := make([]*SigningKey, 0, len(r.keys))
+	for _, entry := range r.keys {
+		if !entry.retired(now) {
+			keys = append(keys, entry.key)
+		}
+	}
+	return PublishedKeys(keys...)
+}
+
+func (k ringKey) retired(now time.Time) bool {
+	return !k.retiresAt.IsZero() && now.After(k.retiresAt)
+}
+
+// GeneratePrivateKey creates a fresh private key for an asymmetric algorithm.
+func GeneratePrivateKey(alg string) (crypto.Signer, error) {
+	switch {
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case alg == "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case alg == "ES384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case alg == "ES512":
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case alg == "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("cannot generate keys for signing algorithm %q", alg)
+}
@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const DefaultSigningAlgorithm = "HS512"
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// KeySet provides the key access tokens are signed with and looks up the
+// keys they are verified with by their kid header.
+type KeySet interface {
+	SigningKey() (*SigningKey, error)
+	VerificationKey(kid string) (*SigningKey, error)
+}
+
+// SigningKey is a single JWT signing key. For HMAC algorithms the private and
+// public halves are the same shared secret.
+type SigningKey struct {
+	ID         string
+	Method     jwt.SigningMethod
+	privateKey interface{}
+	publicKey  interface{}
+}
+
+// NewHMACKey wraps a shared secret as an HS512 key without a kid.
+func NewHMACKey(secret string) *SigningKey {
+	return &SigningKey{
+		Method:     jwt.SigningMethodHS512,
+		privateKey: []byte(secret),
+		publicKey:  []byte(secret),
+	}
+}
+
+// NewSigningKey pairs an asymmetric private key with the algorithm it signs
+// for. When kid is empty the RFC 7638 thumbprint of the public key is used.
+func NewSigningKey(alg, kid string, privateKey crypto.Signer) (*SigningKey, error) {
+	method := jwt.GetSigningMethod(alg)
+	if method == nil {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+
+	if err := checkKeyType(alg, privateKey); err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{
+		ID:         kid,
+		Method:     method,
+		privateKey: privateKey,
+		publicKey:  privateKey.Public(),
+	}
+
+	if key.ID == "" {
+		jwk, err := key.JWK()
+		if err != nil {
+			return nil, err
+		}
+		key.ID = jwk.Thumbprint()
+	}
+
+	return key, nil
+}
+
+// LoadSigningKey builds the key described by the configuration: HMAC
+// algorithms use the shared secret, everything else reads a PEM encoded
+// private key from privateKeyFile.
+func LoadSigningKey(alg, kid, privateKeyFile, secret string) (*SigningKey, error) {
+	if alg == "" {
+		alg = DefaultSigningAlgorithm
+	}
+
+	if strings.HasPrefix(alg, "HS") {
+		method := jwt.GetSigningMethod(alg)
+		if method == nil {
+			return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+		}
+		if secret == "" {
+			return nil, errors.New("a JWT secret key is required for HMAC signing")
+		}
+		key := NewHMACKey(secret)
+		key.ID = kid
+		key.Method = method
+		return key, nil
+	}
+
+	if privateKeyFile == "" {
+		return nil, fmt.Errorf("a private key file is required for %s signing", alg)
+	}
+
+	data, err := os.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading private key: %w", err)
+	}
+
+	privateKey, err := ParsePrivateKeyPEM(alg, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSigningKey(alg, kid, privateKey)
+}
+
+// ParsePrivateKeyPEM decodes a PEM encoded private key of the type alg
+// expects.
+func ParsePrivateKeyPEM(alg string, data []byte) (crypto.Signer, error) {
+	var (
+		key crypto.Signer
+		err error
+	)
+
+	switch {
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		key, err = jwt.ParseRSAPrivateKeyFromPEM(data)
+	case strings.HasPrefix(alg, "ES"):
+		key, err = jwt.ParseECPrivateKeyFromPEM(data)
+	case alg == "EdDSA":
+		var parsed crypto.PrivateKey
+		parsed, err = jwt.ParseEdPrivateKeyFromPEM(data)
+		if err == nil {
+			key, _ = parsed.(crypto.Signer)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key: %w", err)
+	}
+
+	return key, nil
+}
+
+func checkKeyType(alg string, privateKey crypto.Signer) error {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS") {
+			return nil
+		}
+	case *ecdsa.PrivateKey:
+		curves := map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+		if key.Curve.Params().BitSize == curves[alg] {
+			return nil
+		}
+	case ed25519.PrivateKey:
+		if alg == "EdDSA" {
+			return nil
+		}
+	}
+	return fmt.Errorf("private key does not match signing algorithm %s", alg)
+}
+
+// Sign signs claims and stamps the kid header.
+func (k *SigningKey) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.Method, claims)
+	if k.ID != "" {
+		token.Header["kid"] = k.ID
+	}
+	return token.SignedString(k.privateKey)
+}
+
+// Symmetric reports whether the key is a shared secret that must never be
+// published.
+func (k *SigningKey) Symmetric() bool {
+	_, ok := k.publicKey.([]byte)
+	return ok
+}
+
+// SigningKey makes a single key usable as a KeySet.
+func (k *SigningKey) SigningKey() (*SigningKey, error) {
+	return k, nil
+}
+
+// VerificationKey makes a single key usable as a KeySet. Tokens without a kid
+// are accepted so those signed before kids were introduced still verify.
+func (k *SigningKey) VerificationKey(kid string) (*SigningKey, error) {
+	if kid != "" && kid != k.ID {
+		return nil, ErrUnknownKey
+	}
+	return k, nil
+}
+
+// keyfunc resolves the verification key of a token by its kid header and
+// makes sure the token was signed with that key's algorithm.
+func keyfunc(keys KeySet) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := keys.VerificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return key.publicKey, nil
+	}
+}
@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// BcryptMaxPasswordBytes is the longest password bcrypt hashes, it refuses
+// anything longer.
+const BcryptMaxPasswordBytes = 72
+
+// Rules a password can violate, as reported in PasswordRuleError.
+const (
+	PasswordRuleMinLength  = "min_length"
+	PasswordRuleMaxLength  = "max_length"
+	PasswordRuleLowercase  = "lowercase"
+	PasswordRuleUppercase  = "uppercase"
+	PasswordRuleDigit      = "digit"
+	PasswordRuleSymbol     = "symbol"
+	PasswordRuleBannedWord = "banned_word"
+	PasswordRuleStrength   = "strength"
+	PasswordRuleBreached   = "breached"
+)
+
+// Character classes a policy can require.
+const (
+	CharacterClassLowercase = "lowercase"
+	CharacterClassUppercase = "uppercase"
+	CharacterClassDigit     = "digit"
+	CharacterClassSymbol    = "symbol"
+)
+
+// PasswordRuleError is one rule a password violates.
+type PasswordRuleError struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a password violates, so users can fix
+// them all at once.
+type PasswordPolicyError struct {
+	Violations []PasswordRuleError
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		messages = append(messages, violation.Message)
+	}
+	return "password does not meet the policy: " + strings.Join(messages, "; ")
+}
+
+// BreachedPasswords tells whether a password appeared in a data breach.
+type BreachedPasswords interface {
+	Breached(password string) (bool, error)
+}
+
+// PasswordPolicy decides which passwords users may set. MinLength counts
+// characters, MaxLength bytes, and MaxLength is capped at the bcrypt limit.
+// A zero policy only rejects empty passwords and ones bcrypt cannot hash.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	// RequiredClasses are character classes every password must contain
+	RequiredClasses []string
+	// BannedWords may not appear in passwords, ignoring case and common
+	// character substitutions
+	BannedWords []string
+	// MinStrength is the lowest PasswordStrength score accepted, 0 to 4
+	MinStrength int
+	Breached    BreachedPasswords
+}
+
+// ValidateCharacterClasses checks the names of required character classes.
+func ValidateCharacterClasses(classes []string) error {
+	for _, class := range classes {
+		switch strings.TrimSpace(class) {
+		case CharacterClassLowercase, CharacterClassUppercase, CharacterClassDigit, CharacterClassSymbol, "":
+		default:
+			return fmt.Errorf("unknown character class %q", class)
+		}
+	}
+	return nil
+}
+
+// Check validates password against the policy. userInputs are things about
+// the user, such as their email address, that must not make up the password.
+// Violations are returned as a *PasswordPolicyError; other errors mean the
+// breached password corpus could not be read.
+func (p PasswordPolicy) Check(password string, userInputs ...string) error {
+	var violations []PasswordRuleError
+	violate := func(rule, format string, args ...interface{}) {
+		violations = append(violations, PasswordRuleError{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	minLength := p.MinLength
+	if minLength < 1 {
+		minLength = 1
+	}
+	maxLength := p.MaxLength
+	if maxLength <= 0 || maxLength > BcryptMaxPasswordBytes {
+		maxLength = BcryptMaxPasswordBytes
+	}
+
+	// the other rules are not worth running on a password that can never be
+	// accepted, and the strength estimate grows fast with the length
+	if len(password) > maxLength {
+		violate(PasswordRuleMaxLength, "must be at most %d bytes long", maxLength)
+		return &PasswordPolicyError{Violations: violations}
+	}
+	if utf8.RuneCountInString(password) < minLength {
+		violate(PasswordRuleMinLength, "must be at least %d characters long", minLength)
+	}
+
+	present := characterClasses(password)
+	for _, class := range p.RequiredClasses {
+		class = strings.TrimSpace(class)
+		if class != "" && !present[class] {
+			violate(class, "must contain a %s", characterClassNames[class])
+		}
+	}
+
+	banned := append(append([]string(nil), p.BannedWords...), passwordUserWords(userInputs)...)
+	if word := containsBannedWord(password, banned); word != "" {
+		violate(PasswordRuleBannedWord, "must not contain %q", word)
+	}
+
+	if p.MinStrength > 0 {
+		if score := PasswordStrength(password, userInputs...); score < p.MinStrength {
+			violate(PasswordRuleStrength, "is too easy to guess (strength %d of 4, at least %d required)", score, p.MinStrength)
+		}
+	}
+
+	if p.Breached != nil && password != "" {
+		breached, err := p.Breached.Breached(password)
+		if err != nil {
+			return fmt.Errorf("error checking breached passwords: %w", err)
+		}
+		if breached {
+			violate(PasswordRuleBreached, "appeared in a data breach and must not be used")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+var characterClassNames = map[string]string{
+	CharacterClassLowercase: "lowercase letter",
+	CharacterClassUppercase: "uppercase letter",
+	CharacterClassDigit:     "digit",
+	CharacterClassSymbol:    "symbol",
+}
+
+func characterClasses(password string) map[string]bool {
+	present := make(map[string]bool)
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			present[CharacterClassLowercase] = true
+		case unicode.IsUpper(r):
+			present[CharacterClassUppercase] = true
+		case unicode.IsDigit(r):
+			present[CharacterClassDigit] = true
+		default:
+			present[CharacterClassSymbol] = true
+		}
+	}
+	return present
+}
+
+// passwordUserWords splits user inputs into the words a password must not
+// contain: an email address contributes its local part and the parts of it
+// separated by dots, dashes and the like.
+func passwordUserWords(userInputs []string) []string {
+	var words []string
+	for _, input := range userInputs {
+		if local, _, found := strings.Cut(input, "@"); found {
+			input = local
+		}
+		words = append(words, input)
+		words = append(words, strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})...)
+	}
+	return words
+}
+
+// containsBannedWord returns the first banned word found in password. Words
+// shorter than three characters are ignored, they would ban too much.
+func containsBannedWord(password string, banned []string) string {
+	variants := unleet(strings.ToLower(password))
+	for _, word := range banned {
+		word = strings.ToLower(strings.TrimSpace(word))
+		if utf8.RuneCountInString(word) < 3 {
+			continue
+		}
+		for _, variant := range variants {
+			if strings.Contains(variant, word) {
+				return word
+			}
+		}
+	}
+	return ""
+}
+
+// leetReplacers undo the substitutions people make to dress up a word, like
+// "p@ssw0rd". 1 and ! stand for both i and l.
+var leetReplacers = []*strings.Replacer{
+	strings.NewReplacer("0", "o", "1", "i", "!", "i", "3", "e", "4", "a", "@", "a", "5", "s", "$", "s", "7", "t", "+", "t", "|", "l"),
+	strings.NewReplacer("0", "o", "1", "l", "!", "l", "3", "e", "4", "a", "@", "a", "5", "s", "$", "s", "7", "t", "+", "t", "|", "l"),
+}
+
+// unleet returns value as written and with the substitutions undone.
+func unleet(value string) []string {
+	variants := []string{value}
+	for _, replacer := range leetReplacers {
+		variants = append(variants, replacer.Replace(value))
+	}
+	return variants
+}
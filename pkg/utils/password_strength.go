@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"math"
+	"strings"
+)
+
+// commonPasswordWords are words and fragments attackers try first. Matching
+// one costs an attacker about as many guesses as its position in such lists.
+var commonPasswordWords = []string{
+	"password", "passwd", "qwerty", "letmein", "welcome", "admin", "login", "master", "dragon", "monkey",
+	"football", "baseball", "soccer", "hockey", "princess", "sunshine", "shadow", "superman", "batman", "trustno",
+	"iloveyou", "love", "secret", "freedom", "whatever", "starwars", "michael", "jordan", "hunter", "ranger",
+	"killer", "charlie", "thomas", "jessica", "ashley", "daniel", "summer", "winter", "spring", "autumn",
+	"hello", "abc", "test", "guest", "root", "user", "default", "changeme", "access", "mustang",
+	"cookie", "pepper", "ginger", "flower", "computer", "internet", "google", "apple", "samsung", "orange",
+	"banana", "chocolate", "cheese", "pokemon", "matrix", "tigger", "lakers", "yankees", "liverpool", "chelsea",
+	"arsenal", "barcelona", "london", "paris", "berlin", "america", "canada", "money", "angel", "buster",
+	"harley", "silver", "golden", "diamond", "purple", "maggie", "bailey", "jennifer", "hannah", "andrew",
+	"company", "office", "service", "system", "server", "network", "account", "secure", "private", "public",
+}
+
+// keyboardRows are sequences people type by sliding along the keyboard.
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]", "asdfghjkl;'", "zxcvbnm,./", "qazwsxedcrfvtgbyhnujmikolp",
+}
+
+// Guesses, in bits, that each kind of pattern costs an attacker.
+const (
+	commonWordBits  = 10
+	userInputBits   = 3
+	sequenceBits    = 6
+	keyboardBits    = 7
+	yearBits        = 7
+	repeatBaseBits  = 2
+	patternMinRunes = 3
+	// strengthMaxRunes bounds the work of scoring, which grows with the cube
+	// of the length. bcrypt ignores anything past 72 bytes anyway
+	strengthMaxRunes = BcryptMaxPasswordBytes
+	// bruteForceBits is spent on every character no pattern explains. Like
+	// zxcvbn it assumes ten guesses a character rather than the full
+	// alphabet, since attackers try likely characters first
+	bruteForceBits = 3.321928094887362
+)
+
+// PasswordStrength scores how hard a password is to guess, from 0 (trivial)
+// to 4 (very hard), in the manner of zxcvbn: the password is split into
+// dictionary words, the user's own details, keyboard walks, sequences,
+// repeats and years, and brute force for the rest, choosing the cheapest
+// split an attacker could use. The estimated number of guesses maps to
+// scores at 10^3, 10^6, 10^8 and 10^10. Only the first 72 characters are
+// scored.
+func PasswordStrength(password string, userInputs ...string) int {
+	runes := []rune(strings.ToLower(password))
+	if len(runes) == 0 {
+		return 0
+	}
+	if len(runes) > strengthMaxRunes {
+		runes = runes[:strengthMaxRunes]
+	}
+
+	dictionary := passwordUserWords(userInputs)
+
+	// bits[i] is the cheapest way to guess the first i characters
+	bits := make([]float64, len(runes)+1)
+	for end := 1; end <= len(runes); end++ {
+		bits[end] = bits[end-1] + bruteForceBits
+		for start := 0; start <= end-patternMinRunes; start++ {
+			if cost, ok := patternBits(string(runes[start:end]), dictionary); ok && bits[start]+cost < bits[end] {
+				bits[end] = bits[start] + cost
+			}
+		}
+	}
+
+	log10Guesses := bits[len(runes)] * math.Log10(2)
+	switch {
+	case log10Guesses < 3:
+		return 0
+	case log10Guesses < 6:
+		return 1
+	case log10Guesses < 8:
+		return 2
+	case log10Guesses < 10:
+		return 3
+	}
+	return 4
+}
+
+// patternBits returns what guessing segment costs when it follows a known
+// pattern.
+func patternBits(segment string, userWords []string) (float64, bool) {
+	length := float64(len([]rune(segment)))
+	best, found := math.Inf(1), false
+	consider := func(cost float64) {
+		if cost < best {
+			best, found = cost, true
+		}
+	}
+
+	for _, variant := range unleet(segment) {
+		for _, word := range userWords {
+			if strings.EqualFold(variant, word) {
+				consider(userInputBits)
+			}
+		}
+		for _, word := range commonPasswordWords {
+			if variant == word {
+				consider(commonWordBits)
+			}
+		}
+	}
+	if isRepeat(segment) {
+		consider(repeatBaseBits + math.Log2(length))
+	}
+	if isSequence(segment) {
+		consider(sequenceBits + math.Log2(length))
+	}
+	for _, row := range keyboardRows {
+		if strings.Contains(row, segment) || strings.Contains(reverse(row), segment) {
+			consider(keyboardBits + math.Log2(length))
+		}
+	}
+	if isYear(segment) {
+		consider(yearBits)
+	}
+	return best, found
+}
+
+func isRepeat(segment string) bool {
+	runes := []rune(segment)
+	for _, r := range runes[1:] {
+		if r != runes[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// isSequence reports runs like "abcd", "4321" or "acegi" with a constant
+// step of at most two.
+func isSequence(segment string) bool {
+	runes := []rune(segment)
+	step := runes[1] - runes[0]
+	if step == 0 || step > 2 || step < -2 {
+		return false
+	}
+	for i := 2; i < len(runes); i++ {
+		if runes[i]-runes[i-1] != step {
+			return false
+		}
+	}
+	return true
+}
+
+func isYear(segment string) bool {
+	if len(segment) != 4 || (!strings.HasPrefix(segment, "19") && !strings.HasPrefix(segment, "20")) {
+		return false
+	}
+	for _, r := range segment {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func reverse(value string) string {
+	runes := []rune(value)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// RunPeriodically calls task every interval until ctx is done. Failures are
+// logged and the next run goes ahead as planned.
+func RunPeriodically(ctx context.Context, name string, interval time.Duration, task func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := task(); err != nil {
+				log.Printf("%s failed: %v", name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"regexp"
+)
+
+const PKCEMethodS256 = "S256"
+
+// RFC 7636 section 4.1: 43 to 128 unreserved characters
+var codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// PKCEChallenge derives the S256 code challenge of a code verifier.
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// VerifyPKCE checks a code verifier against the S256 challenge sent with the
+// authorization request.
+func VerifyPKCE(verifier, challenge string) bool {
+	if !codeVerifierPattern.MatchString(verifier) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(PKCEChallenge(verifier)), []byte(challenge)) == 1
+}
@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultProxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// ProxyProtocolListener accepts connections that may start with a PROXY
+// protocol v1 or v2 header, as sent by load balancers that pass TCP through.
+// The address in the header replaces the remote address of the connection.
+// Headers are only read from connections of trusted proxies; anyone else
+// could claim any address with one.
+type ProxyProtocolListener struct {
+	net.Listener
+	Trusted func(netip.Addr) bool
+	// HeaderTimeout bounds how long a connection may take to send its header
+	HeaderTimeout time.Duration
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := NormalizeIP(hostOnly(conn.RemoteAddr().String()))
+	if err != nil || l.Trusted == nil || !l.Trusted(remote) {
+		return conn, nil
+	}
+
+	timeout := l.HeaderTimeout
+	if timeout <= 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+	// the header is read on first use, in the connection's own goroutine, so
+	// a slow proxy cannot hold up Accept
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) readHeader() {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		c.err = err
+		return
+	}
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.remoteAddr, c.err = ReadProxyHeader(c.reader)
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+// ReadProxyHeader consumes a PROXY protocol header from r and returns the
+// source address it carries. It returns nil, without consuming anything, when
+// the stream does not start with a header, and nil for headers that carry no
+// address, such as health checks of the proxy itself.
+func ReadProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if bytes.Equal(start, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+	if start[0] == proxyV2Signature[0] {
+		if signature, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(signature, proxyV2Signature) {
+			return readProxyV2(r)
+		}
+	}
+	return nil, nil
+}
+
+// readProxyV1 parses the text header, e.g.
+// "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// at most 107 bytes, so a peer cannot make us buffer an endless line
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: unterminated v1 header", ErrInvalidProxyHeader)
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header", ErrInvalidProxyHeader)
+	}
+
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil || addr.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: invalid source address", ErrInvalidProxyHeader)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid source port", ErrInvalidProxyHeader)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readProxyV2 parses the binary header: the signature, version and command,
+// address family, length and the addresses, followed by TLVs we skip.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version", ErrInvalidProxyHeader)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0:
+		// LOCAL, the proxy talking for itself
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("%w: unsupported command", ErrInvalidProxyHeader)
+	}
+
+	switch family >> 4 {
+	case 0x1:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 addresses", ErrInvalidProxyHeader)
+		}
+		addr := netip.AddrFrom4([4]byte{payload[0], payload[1], payload[2], payload[3]})
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[8:10]))), nil
+	case 0x2:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 addresses", ErrInvalidProxyHeader)
+		}
+		var source [16]byte
+		copy(source[:], payload[:16])
+		addr := netip.AddrFrom16(source)
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[32:34]))), nil
+	}
+	// AF_UNSPEC and unix sockets carry no address we could use
+	return nil, nil
+}
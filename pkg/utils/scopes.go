@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidScope = errors.New("requested scope is not allowed")
+
+// ParseScope splits a space separated scope string into its distinct scopes.
+func ParseScope(scope string) []string {
+	seen := make(map[string]bool)
+	var scopes []string
+	for _, value := range strings.Fields(scope) {
+		if !seen[value] {
+			seen[value] = true
+			scopes = append(scopes, value)
+		}
+	}
+	return scopes
+}
+
+// FormatScope joins scopes in a stable order.
+func FormatScope(scopes []string) string {
+	sorted := ParseScope(strings.Join(scopes, " "))
+	sort.Strings(sorted)
+	return strings.Join(sorted, " ")
+}
+
+// NarrowScope returns the requested scope when every part of it is allowed,
+// or all allowed scopes when nothing was requested.
+func NarrowScope(requested string, allowed []string) (string, error) {
+	scopes := ParseScope(requested)
+	if len(scopes) == 0 {
+		return FormatScope(allowed), nil
+	}
+
+	for _, scope := range scopes {
+		if !ContainsScope(allowed, scope) {
+			return "", ErrInvalidScope
+		}
+	}
+	return FormatScope(scopes), nil
+}
+
+// IntersectScope drops the parts of scope that are not allowed.
+func IntersectScope(scope string, allowed []string) string {
+	var kept []string
+	for _, value := range ParseScope(scope) {
+		if ContainsScope(allowed, value) {
+			kept = append(kept, value)
+		}
+	}
+	return FormatScope(kept)
+}
+
+// ContainsScope reports whether scope is one of scopes.
+func ContainsScope(scopes []string, scope string) bool {
+	for _, candidate := range scopes {
+		if scope == candidate {
+			return true
+		}
+	}
+	return false
+}
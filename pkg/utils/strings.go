@@ -2,6 +2,7 @@ package utils
 
 import (
 	"errors"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 )
@@ -13,3 +14,14 @@ func ConvertStringToUUID(s string) (uuid.UUID, error) {
 	}
 	return u, nil
 }
+
+// TruncateString cuts s to at most max bytes without splitting a UTF-8 rune.
+func TruncateString(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
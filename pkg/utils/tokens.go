@@ -2,24 +2,129 @@ package utils
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
-func GenerateAccessToken(userID, ipAddress, jwtSecretKey string) (string, error) {
-	claims := jwt.MapClaims{
-		"user_id": userID,
-		"ip":      ipAddress,
-		"exp":     time.Now().Add(15 * time.Minute).Unix(),
+const AccessTokenTTL = 15 * time.Minute
+
+// KindServiceAccount marks access tokens of service accounts, whose user_id
+// is the service account's ID rather than a user's.
+const KindServiceAccount = "service_account"
+
+var (
+	ErrTokenRevoked  = errors.New("token has been revoked")
+	ErrWrongAudience = errors.New("token is not intended for this audience")
+)
+
+// Denylist reports whether an access token, identified by its jti, was
+// revoked before it expired.
+type Denylist interface {
+	IsRevoked(jti string) (bool, error)
+}
+
+// Actor is the act claim of a token obtained through token exchange, RFC 8693
+// section 4.1. It names the party acting on behalf of the subject; a nested
+// Actor names whoever delegated to that party in turn.
+type Actor struct {
+	Subject string `json:"sub"`
+	Actor   *Actor `json:"act,omitempty"`
+}
+
+// AccessTokenClaims are the claims of an access token. UserID duplicates sub
+// for clients that predate the registered claims.
+type AccessTokenClaims struct {
+	UserID      string   `json:"user_id"`
+	SessionID   string   `json:"sid,omitempty"`
+	ClientID    string   `json:"client_id,omitempty"`
+	Kind        string   `json:"kind,omitempty"`
+	IPAddress   string   `json:"ip,omitempty"`
+	Scope       string   `json:"scope,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	Actor       *Actor   `json:"act,omitempty"`
+	// Confirmation binds the token to a DPoP key, RFC 9449 section 6
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// AccessTokenParams describes an access token to sign. TokenID becomes the
+// jti claim and is what gets denylisted when the token is revoked; a random
+// one is used when it is empty.
+type AccessTokenParams struct {
+	UserID      string
+	SessionID   string
+	ClientID    string
+	Kind        string
+	TokenID     string
+	IPAddress   string
+	Scope       string
+	Roles       []string
+	Permissions []string
+	Actor       *Actor
+	// JKT is the thumbprint of the DPoP key the token is bound to, if any
+	JKT      string
+	TTL      time.Duration
+	Issuer   string
+	Audience []string
+}
+
+func GenerateAccessToken(params AccessTokenParams, keys KeySet) (string, error) {
+	key, err := keys.SigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	ttl := EffectiveAccessTokenTTL(params.TTL)
+
+	tokenID := params.TokenID
+	if tokenID == "" {
+		tokenID = uuid.NewString()
 	}
 
-	secretKey := []byte(jwtSecretKey)
+	now := time.Now()
+	claims := AccessTokenClaims{
+		UserID:      params.UserID,
+		SessionID:   params.SessionID,
+		ClientID:    params.ClientID,
+		Kind:        params.Kind,
+		IPAddress:   params.IPAddress,
+		Scope:       params.Scope,
+		Roles:       params.Roles,
+		Permissions: params.Permissions,
+		Actor:       params.Actor,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
+			Subject:   params.UserID,
+			Issuer:    params.Issuer,
+			Audience:  params.Audience,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+
+	if params.JKT != "" {
+		claims.Confirmation = &Confirmation{JKT: params.JKT}
+	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
-	return token.SignedString(secretKey)
+	return key.Sign(claims)
+}
+
+// EffectiveAccessTokenTTL caps a requested lifetime at AccessTokenTTL, which
+// is also used when none was requested.
+func EffectiveAccessTokenTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 || ttl > AccessTokenTTL {
+		return AccessTokenTTL
+	}
+	return ttl
 }
 
 func GenerateRefreshToken() (string, error) {
@@ -31,26 +136,91 @@ func GenerateRefreshToken() (string, error) {
 	return base64.StdEncoding.EncodeToString(tokenBytes), nil
 }
 
-func ExtractUserIDFromToken(tokenString, jwtSecretKey string) (string, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(jwtSecretKey), nil
-	})
-	if err != nil {
+// GenerateOpaqueToken returns a random URL-safe token, for values that travel
+// in query strings such as authorization codes.
+func GenerateOpaqueToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
 		return "", err
 	}
+	return base64.RawURLEncoding.EncodeToString(tokenBytes), nil
+}
+
+// HashToken returns the hex SHA-256 digest of a high-entropy token, so stored
+// tokens can be looked up directly instead of compared one by one.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenVerifier checks access tokens. Besides signature and expiry it
+// enforces the issuer and audiences when they are set, rejects tokens whose
+// nbf or iat lie in the future by more than Leeway and, given a denylist,
+// tokens that were revoked.
+type TokenVerifier struct {
+	Keys      KeySet
+	Denylist  Denylist
+	Issuer    string
+	Audiences []string
+	Leeway    time.Duration
+}
+
+func (v TokenVerifier) Verify(tokenString string) (*AccessTokenClaims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithLeeway(v.Leeway),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+	}
+	if v.Issuer != "" {
+		options = append(options, jwt.WithIssuer(v.Issuer))
+	}
+
+	claims := &AccessTokenClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyfunc(v.Keys), options...)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	if len(v.Audiences) > 0 && !audienceAllowed(claims.Audience, v.Audiences) {
+		return nil, ErrWrongAudience
+	}
+
+	if v.Denylist != nil && claims.ID != "" {
+		revoked, err := v.Denylist.IsRevoked(claims.ID)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+
+	return claims, nil
+}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok || !token.Valid {
-		return "", fmt.Errorf("invalid token")
+func audienceAllowed(audience jwt.ClaimStrings, allowed []string) bool {
+	for _, aud := range audience {
+		for _, candidate := range allowed {
+			if aud == candidate {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ExtractUserIDFromToken(tokenString string, verifier TokenVerifier) (string, error) {
+	claims, err := verifier.Verify(tokenString)
+	if err != nil {
+		return "", err
 	}
 
-	userID, ok := claims["user_id"].(string)
-	if !ok {
+	if claims.UserID == "" {
 		return "", fmt.Errorf("user_id not found in token")
 	}
 
-	return userID, nil
+	return claims.UserID, nil
 }
@@ -1,23 +1,59 @@
 package testing
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"test-task/initializer"
+	"test-task/internal/config"
+	"test-task/internal/middleware"
+	"test-task/internal/modules/auth/models"
+	"test-task/internal/modules/oauth"
+	oauthmodels "test-task/internal/modules/oauth/models"
 	"test-task/pkg/utils"
 	"testing"
 	"time"
 
 	"fmt"
 
+	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestGenerateAccessToken(t *testing.T) {
 	userID := "6ab58fc3-6920-48a0-8851-a2f0650fa2a5"
+	sessionID := "0f6c1a3e-5a7e-4a52-9a43-3d8a1c3b7e11"
+	tokenID := "b1d2c3e4-7f80-4a91-b2c3-d4e5f6a7b8c9"
 	ipAddress := "192.168.0.1"
 	jwtSecretKey := "test-secret-key"
 
-	token, err := utils.GenerateAccessToken(userID, ipAddress, jwtSecretKey)
+	params := utils.AccessTokenParams{
+		UserID:    userID,
+		SessionID: sessionID,
+		TokenID:   tokenID,
+		IPAddress: ipAddress,
+	}
+	token, err := utils.GenerateAccessToken(params, utils.NewHMACKey(jwtSecretKey))
 	assert.NoError(t, err, "expected no error when generating access token")
 	assert.NotEmpty(t, token, "expected token to be non-empty")
 
@@ -34,6 +70,8 @@ func TestGenerateAccessToken(t *testing.T) {
 	assert.True(t, ok, "expected claims to be of type MapClaims")
 	assert.Equal(t, userID, claims["user_id"], "expected user_id to match")
 	assert.Equal(t, ipAddress, claims["ip"], "expected ip to match")
+	assert.Equal(t, sessionID, claims["sid"], "expected sid to match")
+	assert.Equal(t, tokenID, claims["jti"], "expected jti to match")
 
 	exp := claims["exp"].(float64)
 	assert.True(t, exp > float64(time.Now().Unix()), "expected expiration time to be in the future")
@@ -54,14 +92,129 @@ func TestExtractUserIDFromToken(t *testing.T) {
 	ipAddress := "192.168.0.1"
 	jwtSecretKey := "test-secret-key"
 
-	token, err := utils.GenerateAccessToken(userID, ipAddress, jwtSecretKey)
+	token, err := utils.GenerateAccessToken(utils.AccessTokenParams{UserID: userID, IPAddress: ipAddress}, utils.NewHMACKey(jwtSecretKey))
 	assert.NoError(t, err, "expected no error when generating access token")
 
-	extractedUserID, err := utils.ExtractUserIDFromToken(token, jwtSecretKey)
+	extractedUserID, err := utils.ExtractUserIDFromToken(token, utils.TokenVerifier{Keys: utils.NewHMACKey(jwtSecretKey)})
 	assert.NoError(t, err, "expected no error when extracting user_id from token")
 	assert.Equal(t, userID, extractedUserID, "expected extracted user_id to match")
 }
 
+func TestGenerateAccessTokenRestrictions(t *testing.T) {
+	jwtSecretKey := "test-secret-key"
+	params := utils.AccessTokenParams{
+		UserID: "6ab58fc3-6920-48a0-8851-a2f0650fa2a5",
+		Scope:  "profile:read",
+		TTL:    time.Minute,
+	}
+
+	token, err := utils.GenerateAccessToken(params, utils.NewHMACKey(jwtSecretKey))
+	assert.NoError(t, err, "expected no error when generating access token")
+
+	verifier := utils.TokenVerifier{Keys: utils.NewHMACKey(jwtSecretKey)}
+	claims, err := verifier.Verify(token)
+	assert.NoError(t, err, "expected no error when parsing token")
+	assert.Equal(t, "profile:read", claims.Scope, "expected scope to match")
+	assert.LessOrEqual(t, claims.ExpiresAt.Unix(), time.Now().Add(time.Minute).Unix(), "expected restricted lifetime to be honoured")
+
+	params.TTL = time.Hour
+	token, err = utils.GenerateAccessToken(params, utils.NewHMACKey(jwtSecretKey))
+	assert.NoError(t, err, "expected no error when generating access token")
+
+	claims, err = verifier.Verify(token)
+	assert.NoError(t, err, "expected no error when parsing token")
+	assert.LessOrEqual(t, claims.ExpiresAt.Unix(), time.Now().Add(utils.AccessTokenTTL).Unix(), "expected lifetime to be capped")
+}
+
+func TestGenerateAccessTokenActor(t *testing.T) {
+	key := utils.NewHMACKey("test-secret-key")
+	params := utils.AccessTokenParams{
+		UserID: "6ab58fc3-6920-48a0-8851-a2f0650fa2a5",
+		Actor: &utils.Actor{
+			Subject: "sa-billing",
+			Actor:   &utils.Actor{Subject: "sa-gateway"},
+		},
+	}
+
+	token, err := utils.GenerateAccessToken(params, key)
+	assert.NoError(t, err, "expected no error when generating access token")
+
+	claims, err := utils.TokenVerifier{Keys: key}.Verify(token)
+	assert.NoError(t, err, "expected no error when parsing token")
+	assert.Equal(t, params.UserID, claims.Subject, "expected the subject to stay the user")
+	assert.Equal(t, "sa-billing", claims.Actor.Subject, "expected act to name the calling service")
+	assert.Equal(t, "sa-gateway", claims.Actor.Actor.Subject, "expected the previous actor to be nested")
+}
+
+func TestVerifyRegisteredClaims(t *testing.T) {
+	key := utils.NewHMACKey("test-secret-key")
+	params := utils.AccessTokenParams{
+		UserID:   "6ab58fc3-6920-48a0-8851-a2f0650fa2a5",
+		Issuer:   "test-task",
+		Audience: []string{"billing"},
+	}
+
+	token, err := utils.GenerateAccessToken(params, key)
+	assert.NoError(t, err, "expected no error when generating access token")
+
+	verifier := utils.TokenVerifier{Keys: key, Issuer: "test-task", Audiences: []string{"billing", "reports"}}
+	claims, err := verifier.Verify(token)
+	assert.NoError(t, err, "expected token for an allowed audience to be accepted")
+	assert.Equal(t, params.UserID, claims.Subject, "expected sub to carry the user id")
+	assert.NotEmpty(t, claims.ID, "expected a jti to be generated")
+	assert.NotNil(t, claims.IssuedAt, "expected iat to be set")
+	assert.NotNil(t, claims.NotBefore, "expected nbf to be set")
+
+	_, err = utils.TokenVerifier{Keys: key, Issuer: "someone-else"}.Verify(token)
+	assert.Error(t, err, "expected token from another issuer to be rejected")
+
+	_, err = utils.TokenVerifier{Keys: key, Audiences: []string{"reports"}}.Verify(token)
+	assert.ErrorIs(t, err, utils.ErrWrongAudience, "expected token for another audience to be rejected")
+
+	future := utils.AccessTokenClaims{
+		UserID: params.UserID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+			NotBefore: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(10 * time.Minute)),
+		},
+	}
+	skewed, err := key.Sign(future)
+	assert.NoError(t, err)
+
+	_, err = utils.TokenVerifier{Keys: key, Leeway: time.Minute}.Verify(skewed)
+	assert.Error(t, err, "expected token from the future beyond the leeway to be rejected")
+
+	_, err = utils.TokenVerifier{Keys: key, Leeway: 10 * time.Minute}.Verify(skewed)
+	assert.NoError(t, err, "expected clock skew within the leeway to be tolerated")
+}
+
+type denylistStub map[string]bool
+
+func (d denylistStub) IsRevoked(jti string) (bool, error) {
+	return d[jti], nil
+}
+
+func TestVerifyDenylist(t *testing.T) {
+	jwtSecretKey := "test-secret-key"
+
+	params := utils.AccessTokenParams{
+		UserID:    "6ab58fc3-6920-48a0-8851-a2f0650fa2a5",
+		TokenID:   "revoked-jti",
+		IPAddress: "192.168.0.1",
+	}
+	token, err := utils.GenerateAccessToken(params, utils.NewHMACKey(jwtSecretKey))
+	assert.NoError(t, err, "expected no error when generating access token")
+
+	verifier := utils.TokenVerifier{Keys: utils.NewHMACKey(jwtSecretKey), Denylist: denylistStub{}}
+	_, err = verifier.Verify(token)
+	assert.NoError(t, err, "expected token that is not denylisted to be accepted")
+
+	verifier.Denylist = denylistStub{"revoked-jti": true}
+	_, err = verifier.Verify(token)
+	assert.ErrorIs(t, err, utils.ErrTokenRevoked, "expected denylisted token to be rejected")
+}
+
 func TestConvertStringToUUID(t *testing.T) {
 	validUUID := "6ab58fc3-6920-48a0-8851-a2f0650fa2a5"
 	invalidUUID := "invalid-uuid-string"
@@ -74,3 +227,776 @@ func TestConvertStringToUUID(t *testing.T) {
 	assert.Error(t, err, "expected error for invalid UUID string")
 	assert.EqualError(t, err, "invalid UUID string", "expected error message to be 'invalid UUID string'")
 }
+
+func TestHashToken(t *testing.T) {
+	hash := utils.HashToken("refresh-token")
+	assert.Len(t, hash, 64, "expected hex encoded SHA-256 digest")
+	assert.Equal(t, hash, utils.HashToken("refresh-token"), "expected hashing to be deterministic")
+	assert.NotEqual(t, hash, utils.HashToken("other-token"), "expected different tokens to hash differently")
+}
+
+func TestTruncateString(t *testing.T) {
+	assert.Equal(t, "short", utils.TruncateString("short", 10))
+	assert.Equal(t, "trunc", utils.TruncateString("truncated", 5))
+	assert.Equal(t, "ab", utils.TruncateString("abвг", 3), "expected multi-byte rune not to be split")
+}
+
+func TestTokenToSession(t *testing.T) {
+	familyID := uuid.New()
+	token := models.Token{
+		ID:               uuid.New(),
+		FamilyID:         familyID,
+		RefreshTokenHash: utils.HashToken("refresh-token"),
+		DeviceLabel:      "laptop",
+		IPAddress:        "192.168.0.1",
+	}
+
+	session := token.ToSession(familyID)
+	assert.Equal(t, familyID, session.ID, "expected session id to be the token family")
+	assert.True(t, session.Current, "expected session to be flagged as current")
+	assert.False(t, token.ToSession(uuid.New()).Current, "expected other sessions not to be flagged as current")
+
+	data, err := json.Marshal(session)
+	assert.NoError(t, err, "expected no error when serializing session")
+	assert.NotContains(t, string(data), token.RefreshTokenHash, "expected refresh token hash not to be exposed")
+}
+
+func TestAdminCredentials(t *testing.T) {
+	cfg := &config.Config{AdminAPIKeys: "ops:key-one, billing-job:key-two,broken,:no-name"}
+
+	credentials := cfg.AdminCredentials()
+	assert.Equal(t, map[string]string{"key-one": "ops", "key-two": "billing-job"}, credentials)
+}
+
+func TestAsymmetricSigningKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	cases := map[string]crypto.Signer{
+		"RS256": rsaKey,
+		"ES256": ecKey,
+		"EdDSA": edKey,
+	}
+
+	for alg, privateKey := range cases {
+		key, err := utils.NewSigningKey(alg, "", privateKey)
+		assert.NoError(t, err, "expected %s key to be accepted", alg)
+		assert.NotEmpty(t, key.ID, "expected kid to default to the key thumbprint")
+
+		token, err := utils.GenerateAccessToken(utils.AccessTokenParams{UserID: "6ab58fc3-6920-48a0-8851-a2f0650fa2a5"}, key)
+		assert.NoError(t, err, "expected no error when signing with %s", alg)
+
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+		assert.NoError(t, err)
+		assert.Equal(t, alg, parsed.Header["alg"], "expected alg header to match")
+		assert.Equal(t, key.ID, parsed.Header["kid"], "expected kid header to match")
+
+		userID, err := utils.ExtractUserIDFromToken(token, utils.TokenVerifier{Keys: key})
+		assert.NoError(t, err, "expected %s token to verify", alg)
+		assert.Equal(t, "6ab58fc3-6920-48a0-8851-a2f0650fa2a5", userID)
+
+		jwks := utils.PublishedKeys(key)
+		assert.Len(t, jwks.Keys, 1, "expected public key to be published")
+		assert.Equal(t, key.ID, jwks.Keys[0].KeyID)
+		assert.Equal(t, alg, jwks.Keys[0].Algorithm)
+	}
+
+	_, err = utils.NewSigningKey("ES256", "", rsaKey)
+	assert.Error(t, err, "expected mismatched key type to be rejected")
+
+	assert.Empty(t, utils.PublishedKeys(utils.NewHMACKey("secret")).Keys, "expected shared secrets never to be published")
+}
+
+func TestVerificationRejectsUnknownKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	signer, err := utils.NewSigningKey("ES256", "signer", ecKey)
+	assert.NoError(t, err)
+	other, err := utils.NewSigningKey("ES256", "other", ecKey)
+	assert.NoError(t, err)
+
+	token, err := utils.GenerateAccessToken(utils.AccessTokenParams{UserID: "6ab58fc3-6920-48a0-8851-a2f0650fa2a5"}, signer)
+	assert.NoError(t, err)
+
+	_, err = utils.TokenVerifier{Keys: other}.Verify(token)
+	assert.Error(t, err, "expected token with an unknown kid to be rejected")
+
+	_, err = utils.TokenVerifier{Keys: utils.NewHMACKey("secret")}.Verify(token)
+	assert.Error(t, err, "expected token signed with another algorithm to be rejected")
+}
+
+func TestJWKThumbprint(t *testing.T) {
+	// example key from RFC 7638, section 3.1
+	jwk := utils.JWK{
+		KeyType: "RSA",
+		N:       "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:       "AQAB",
+	}
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", jwk.Thumbprint())
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	legacy := utils.NewHMACKey("legacy-secret")
+
+	oldPrivate, err := utils.GeneratePrivateKey("ES256")
+	assert.NoError(t, err)
+	oldKey, err := utils.NewSigningKey("ES256", "old", oldPrivate)
+	assert.NoError(t, err)
+
+	newPrivate, err := utils.GeneratePrivateKey("EdDSA")
+	assert.NoError(t, err)
+	newKey, err := utils.NewSigningKey("EdDSA", "new", newPrivate)
+	assert.NoError(t, err)
+
+	ring := utils.NewKeyRing()
+	ring.Add(legacy, time.Time{})
+	ring.Add(oldKey, time.Time{})
+	assert.NoError(t, ring.Activate("old"))
+
+	legacyToken, err := utils.GenerateAccessToken(utils.AccessTokenParams{UserID: "legacy"}, legacy)
+	assert.NoError(t, err)
+	oldToken, err := utils.GenerateAccessToken(utils.AccessTokenParams{UserID: "old"}, ring)
+	assert.NoError(t, err)
+
+	// promote the new key, the old one keeps verifying until it retires
+	ring.Add(newKey, time.Time{})
+	assert.NoError(t, ring.Activate("new"))
+	ring.Add(oldKey, time.Now().Add(time.Hour))
+
+	newToken, err := utils.GenerateAccessToken(utils.AccessTokenParams{UserID: "new"}, ring)
+	assert.NoError(t, err)
+
+	for _, token := range []string{legacyToken, oldToken, newToken} {
+		_, err := utils.ExtractUserIDFromToken(token, utils.TokenVerifier{Keys: ring})
+		assert.NoError(t, err, "expected tokens of every live key to verify")
+	}
+	assert.Len(t, ring.PublishedKeys().Keys, 2, "expected both asymmetric keys to be published")
+
+	// once retired the old key no longer verifies nor is published
+	ring.Add(oldKey, time.Now().Add(-time.Second))
+	_, err = utils.ExtractUserIDFromToken(oldToken, utils.TokenVerifier{Keys: ring})
+	assert.Error(t, err, "expected tokens of a retired key to be rejected")
+	assert.Len(t, ring.PublishedKeys().Keys, 1, "expected retired key to be unpublished")
+
+	assert.ErrorIs(t, ring.Activate("missing"), utils.ErrUnknownKey)
+}
+
+func TestEncryptSecret(t *testing.T) {
+	sealed, err := utils.EncryptSecret("passphrase", []byte("private key"))
+	assert.NoError(t, err)
+	assert.NotContains(t, sealed, "private key")
+
+	opened, err := utils.DecryptSecret("passphrase", sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "private key", string(opened))
+
+	_, err = utils.DecryptSecret("wrong passphrase", sealed)
+	assert.Error(t, err, "expected decryption with the wrong passphrase to fail")
+}
+
+func TestAuthenticateMiddleware(t *testing.T) {
+	key := utils.NewHMACKey("test-secret-key")
+	userID := "6ab58fc3-6920-48a0-8851-a2f0650fa2a5"
+
+	app := gin.New()
+	authenticate := middleware.Authenticate(middleware.AuthOptions{Verifier: utils.TokenVerifier{Keys: key}})
+	app.GET("/profile", authenticate, middleware.RequireScope("profile:read"), func(c *gin.Context) {
+		principal := middleware.CurrentPrincipal(c)
+		c.String(http.StatusOK, principal.UserID.String())
+	})
+
+	request := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		app.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request("").Code, "expected missing token to be rejected")
+	assert.Equal(t, http.StatusUnauthorized, request("not-a-jwt").Code, "expected invalid token to be rejected")
+
+	narrow, err := utils.GenerateAccessToken(utils.AccessTokenParams{UserID: userID, Scope: "sessions:read"}, key)
+	assert.NoError(t, err)
+	forbidden := request(narrow)
+	assert.Equal(t, http.StatusForbidden, forbidden.Code, "expected token without the scope to be forbidden")
+	assert.Contains(t, forbidden.Header().Get("WWW-Authenticate"), "insufficient_scope")
+
+	scoped, err := utils.GenerateAccessToken(utils.AccessTokenParams{UserID: userID, Scope: "sessions:read profile:read"}, key)
+	assert.NoError(t, err)
+	allowed := request(scoped)
+	assert.Equal(t, http.StatusOK, allowed.Code, "expected token with the scope to be accepted")
+	assert.Equal(t, userID, allowed.Body.String(), "expected principal to carry the user id")
+}
+
+func TestRequireAdminMiddleware(t *testing.T) {
+	key := utils.NewHMACKey("test-secret-key")
+	userID := "6ab58fc3-6920-48a0-8851-a2f0650fa2a5"
+	cfg := &config.Config{AdminAPIKeys: "ops:admin-key"}
+	options := middleware.AuthOptions{Verifier: utils.TokenVerifier{Keys: key}}
+
+	app := gin.New()
+	app.GET("/admin/users", middleware.RequireAdmin(cfg, options, "users:read"), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(middleware.AdminContextKey))
+	})
+
+	request := func(adminKey, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+		if adminKey != "" {
+			req.Header.Set(middleware.AdminKeyHeader, adminKey)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		app.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	viaKey := request("admin-key", "")
+	assert.Equal(t, http.StatusOK, viaKey.Code, "expected admin key to be accepted")
+	assert.Equal(t, "ops", viaKey.Body.String())
+
+	assert.Equal(t, http.StatusForbidden, request("wrong-key", "").Code, "expected unknown admin key to be rejected")
+	assert.Equal(t, http.StatusUnauthorized, request("", "").Code, "expected anonymous caller to be rejected")
+
+	plain, err := utils.GenerateAccessToken(utils.AccessTokenParams{UserID: userID, Roles: []string{"support"}}, key)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, request("", plain).Code, "expected user without the permission to be forbidden")
+
+	granted, err := utils.GenerateAccessToken(utils.AccessTokenParams{
+		UserID:      userID,
+		Roles:       []string{"support"},
+		Permissions: []string{"users:read"},
+	}, key)
+	assert.NoError(t, err)
+	viaUser := request("", granted)
+	assert.Equal(t, http.StatusOK, viaUser.Code, "expected user with the permission to be accepted")
+	assert.Equal(t, "user:"+userID, viaUser.Body.String())
+
+	service, err := utils.GenerateAccessToken(utils.AccessTokenParams{
+		UserID:      uuid.NewString(),
+		ClientID:    "sa-reporting",
+		Kind:        utils.KindServiceAccount,
+		Permissions: []string{"users:read"},
+	}, key)
+	assert.NoError(t, err)
+	viaServiceAccount := request("", service)
+	assert.Equal(t, http.StatusOK, viaServiceAccount.Code, "expected service account with the permission to be accepted")
+	assert.Equal(t, "service_account:sa-reporting", viaServiceAccount.Body.String())
+}
+
+func TestNarrowScope(t *testing.T) {
+	allowed := []string{"profile", "sessions", "users:read"}
+
+	scope, err := utils.NarrowScope("", allowed)
+	assert.NoError(t, err)
+	assert.Equal(t, "profile sessions users:read", scope, "expected all allowed scopes by default")
+
+	scope, err = utils.NarrowScope("sessions  profile sessions", allowed)
+	assert.NoError(t, err)
+	assert.Equal(t, "profile sessions", scope, "expected requested scopes to be normalized")
+
+	_, err = utils.NarrowScope("profile keys:manage", allowed)
+	assert.ErrorIs(t, err, utils.ErrInvalidScope, "expected scope outside the allowed set to be rejected")
+}
+
+func TestVerifyPKCE(t *testing.T) {
+	// RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	assert.Equal(t, challenge, utils.PKCEChallenge(verifier))
+	assert.True(t, utils.VerifyPKCE(verifier, challenge), "expected matching verifier to be accepted")
+	assert.False(t, utils.VerifyPKCE(verifier+"x", challenge), "expected other verifier to be rejected")
+	assert.False(t, utils.VerifyPKCE("short", utils.PKCEChallenge("short")), "expected too short verifier to be rejected")
+}
+
+func TestValidateRedirectURI(t *testing.T) {
+	valid := []string{
+		"https://app.example.com/callback",
+		"http://localhost:8080/callback",
+		"http://127.0.0.1/callback",
+		"com.example.app:/oauth",
+	}
+	for _, uri := range valid {
+		assert.NoError(t, oauth.ValidateRedirectURI(uri), "expected %s to be accepted", uri)
+	}
+
+	invalid := []string{
+		"/callback",
+		"http://app.example.com/callback",
+		"https://app.example.com/callback#fragment",
+		"javascript:alert(1)",
+	}
+	for _, uri := range invalid {
+		assert.Error(t, oauth.ValidateRedirectURI(uri), "expected %s to be rejected", uri)
+	}
+}
+
+func TestClientAllowsGrant(t *testing.T) {
+	legacy := oauthmodels.Client{}
+	assert.True(t, legacy.AllowsGrant("authorization_code"), "expected clients without grant types to keep the code grant")
+	assert.True(t, legacy.AllowsGrant("refresh_token"))
+	assert.False(t, legacy.AllowsGrant(oauth.GrantTypeDeviceCode))
+
+	cli := oauthmodels.Client{GrantTypes: oauthmodels.StringList{oauth.GrantTypeDeviceCode}}
+	assert.True(t, cli.AllowsGrant(oauth.GrantTypeDeviceCode))
+	assert.False(t, cli.AllowsGrant("authorization_code"), "expected grants to be limited to the registered ones")
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+	assert.Equal(t, "BCDFGHJK", oauth.NormalizeUserCode("BCDF-GHJK"))
+	assert.Equal(t, "BCDFGHJK", oauth.NormalizeUserCode(" bcdf ghjk "))
+	assert.Equal(t, "BCDFGHJK", oauth.NormalizeUserCode("bcdfghjk"))
+}
+
+func TestGenerateIDToken(t *testing.T) {
+	key := utils.NewHMACKey("test-secret-key")
+	authTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	idToken, err := utils.GenerateIDToken(utils.IDTokenParams{
+		Subject:  "6ab58fc3-6920-48a0-8851-a2f0650fa2a5",
+		ClientID: "client-1",
+		Issuer:   "https://id.example.com",
+		Nonce:    "n-0S6_WzA2Mj",
+		AuthTime: authTime,
+		AMR:      []string{"pwd"},
+		Email:    "user@example.com",
+	}, key)
+	assert.NoError(t, err)
+
+	claims := &utils.IDTokenClaims{}
+	_, err = jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte("test-secret-key"), nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, jwt.ClaimStrings{"client-1"}, claims.Audience, "expected the client to be the audience")
+	assert.Equal(t, "n-0S6_WzA2Mj", claims.Nonce)
+	assert.Equal(t, authTime.Unix(), claims.AuthTime.Unix())
+	assert.Equal(t, "user@example.com", claims.Email)
+	if assert.NotNil(t, claims.EmailVerified) {
+		assert.False(t, *claims.EmailVerified)
+	}
+
+	// ID tokens must not be accepted where access tokens are expected
+	_, err = utils.TokenVerifier{Keys: key, Audiences: []string{"test-task"}}.Verify(idToken)
+	assert.Error(t, err)
+}
+
+func TestValidateIssuerURL(t *testing.T) {
+	assert.NoError(t, utils.ValidateIssuerURL("https://id.example.com"))
+	assert.NoError(t, utils.ValidateIssuerURL("https://example.com/identity"))
+	assert.NoError(t, utils.ValidateIssuerURL("http://localhost:8080"))
+	assert.NoError(t, utils.ValidateIssuerURL("http://127.0.0.1:8080"))
+
+	for _, issuer := range []string{"test-task", "http://id.example.com", "https://id.example.com?tenant=1", "https://id.example.com#top", "//id.example.com"} {
+		assert.ErrorIs(t, utils.ValidateIssuerURL(issuer), utils.ErrInvalidIssuerURL, issuer)
+	}
+}
+
+func TestAuthorizationRequestMaxAge(t *testing.T) {
+	maxAge, ok := oauth.AuthorizationRequest{MaxAgeSeconds: "300"}.MaxAge()
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Minute, maxAge)
+
+	_, ok = oauth.AuthorizationRequest{MaxAgeSeconds: "-1"}.MaxAge()
+	assert.False(t, ok, "expected negative max_age to be rejected")
+
+	request := oauth.AuthorizationRequest{Prompt: "login consent"}
+	assert.True(t, request.HasPrompt("consent"))
+	assert.False(t, request.HasPrompt("none"))
+}
+
+type replayCacheStub map[string]bool
+
+func (r replayCacheStub) Remember(id string, expiresAt time.Time) (bool, error) {
+	if r[id] {
+		return false, nil
+	}
+	r[id] = true
+	return true, nil
+}
+
+// dpopProof signs a DPoP proof with key, embedding its public half.
+func dpopProof(t *testing.T, key *ecdsa.PrivateKey, method, url, accessToken string) string {
+	jwk, err := utils.PublicJWK(&key.PublicKey)
+	assert.NoError(t, err)
+
+	claims := utils.DPoPClaims{
+		HTM: method,
+		HTU: url,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       uuid.NewString(),
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		},
+	}
+	if accessToken != "" {
+		claims.ATH = utils.AccessTokenHash(accessToken)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = utils.DPoPProofType
+	token.Header["jwk"] = jwk
+	proof, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return proof
+}
+
+func TestDPoPProofVerification(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwk, err := utils.PublicJWK(&key.PublicKey)
+	assert.NoError(t, err)
+
+	verifier := utils.DPoPVerifier{ReplayCache: replayCacheStub{}}
+	url := "https://id.example.com/api/v1/auth/login"
+
+	proof := dpopProof(t, key, http.MethodPost, url, "")
+	jkt, err := verifier.Verify(proof, http.MethodPost, "https://ID.example.com:443/api/v1/auth/login?next=1", "")
+	assert.NoError(t, err, "expected the htu to match after normalization")
+	assert.Equal(t, jwk.Thumbprint(), jkt)
+
+	_, err = verifier.Verify(proof, http.MethodPost, url, "")
+	assert.ErrorIs(t, err, utils.ErrDPoPProofReused, "expected a replayed proof to be rejected")
+
+	_, err = verifier.Verify(dpopProof(t, key, http.MethodGet, url, ""), http.MethodPost, url, "")
+	assert.ErrorIs(t, err, utils.ErrInvalidDPoPProof, "expected a proof for another method to be rejected")
+
+	_, err = verifier.Verify(dpopProof(t, key, http.MethodPost, "https://id.example.com/other", ""), http.MethodPost, url, "")
+	assert.ErrorIs(t, err, utils.ErrInvalidDPoPProof, "expected a proof for another URL to be rejected")
+
+	_, err = verifier.Verify(dpopProof(t, key, http.MethodPost, url, "other-token"), http.MethodPost, url, "access-token")
+	assert.ErrorIs(t, err, utils.ErrInvalidDPoPProof, "expected a proof for another access token to be rejected")
+
+	// proofs must not be signed with a shared secret
+	hmacProof := jwt.NewWithClaims(jwt.SigningMethodHS256, utils.DPoPClaims{HTM: http.MethodPost, HTU: url})
+	hmacProof.Header["typ"] = utils.DPoPProofType
+	signed, err := hmacProof.SignedString([]byte("secret"))
+	assert.NoError(t, err)
+	_, err = verifier.Verify(signed, http.MethodPost, url, "")
+	assert.ErrorIs(t, err, utils.ErrInvalidDPoPProof)
+}
+
+func TestAuthenticateMiddlewareDPoP(t *testing.T) {
+	signingKey := utils.NewHMACKey("test-secret-key")
+	proofKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwk, err := utils.PublicJWK(&proofKey.PublicKey)
+	assert.NoError(t, err)
+
+	dpop := utils.DPoPVerifier{ReplayCache: replayCacheStub{}, BaseURL: "https://id.example.com"}
+	app := gin.New()
+	app.GET("/profile", middleware.Authenticate(middleware.AuthOptions{Verifier: utils.TokenVerifier{Keys: signingKey}, DPoP: dpop}), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	request := func(scheme, token, proof string) int {
+		req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+		req.Header.Set("Authorization", scheme+" "+token)
+		if proof != "" {
+			req.Header.Set(middleware.DPoPHeader, proof)
+		}
+		recorder := httptest.NewRecorder()
+		app.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	userID := "6ab58fc3-6920-48a0-8851-a2f0650fa2a5"
+	bound, err := utils.GenerateAccessToken(utils.AccessTokenParams{UserID: userID, JKT: jwk.Thumbprint()}, signingKey)
+	assert.NoError(t, err)
+	url := "https://id.example.com/profile"
+
+	assert.Equal(t, http.StatusUnauthorized, request("Bearer", bound, ""), "expected a bound token to need the DPoP scheme")
+	assert.Equal(t, http.StatusUnauthorized, request("DPoP", bound, ""), "expected a bound token to need a proof")
+	assert.Equal(t, http.StatusOK, request("DPoP", bound, dpopProof(t, proofKey, http.MethodGet, url, bound)))
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, request("DPoP", bound, dpopProof(t, otherKey, http.MethodGet, url, bound)),
+		"expected a proof by another key to be rejected")
+
+	unbound, err := utils.GenerateAccessToken(utils.AccessTokenParams{UserID: userID}, signingKey)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, request("DPoP", unbound, dpopProof(t, proofKey, http.MethodGet, url, unbound)),
+		"expected the DPoP scheme to be refused for a bearer token")
+	assert.Equal(t, http.StatusOK, request("Bearer", unbound, ""))
+}
+
+func TestIPBindingPolicy(t *testing.T) {
+	strict := utils.IPBindingPolicy{Mode: utils.IPBindingStrict}
+	assert.Equal(t, utils.IPDecisionMatch, strict.Decide("203.0.113.7", "::ffff:203.0.113.7"), "expected IPv4-mapped addresses to match")
+	assert.Equal(t, utils.IPDecisionMatch, strict.Decide("2001:db8::1", "2001:DB8:0::1"))
+	assert.Equal(t, utils.IPDecisionRejected, strict.Decide("203.0.113.7", "203.0.113.8"))
+	assert.Equal(t, utils.IPDecisionSkipped, strict.Decide("", "203.0.113.8"), "expected sessions without an address to be skipped")
+
+	subnet := strict.WithMode(utils.IPBindingSameSubnet)
+	assert.Equal(t, utils.IPDecisionSameSubnet, subnet.Decide("203.0.113.7", "203.0.113.200"))
+	assert.Equal(t, utils.IPDecisionRejected, subnet.Decide("203.0.113.7", "203.0.114.7"))
+	assert.Equal(t, utils.IPDecisionSameSubnet, subnet.Decide("2001:db8:0:1::1", "2001:db8:0:1:ffff::2"))
+	assert.Equal(t, utils.IPDecisionRejected, subnet.Decide("2001:db8:0:1::1", "2001:db8:0:2::1"))
+	assert.Equal(t, utils.IPDecisionRejected, subnet.Decide("203.0.113.7", "64:ff9b::cb00:7107"), "expected IPv4 and IPv6 subnets not to mix")
+
+	wide := utils.IPBindingPolicy{Mode: utils.IPBindingSameSubnet, IPv4Prefix: 16}
+	assert.Equal(t, utils.IPDecisionSameSubnet, wide.Decide("203.0.113.7", "203.0.200.1"))
+
+	warn := strict.WithMode(utils.IPBindingWarnOnly)
+	assert.Equal(t, utils.IPDecisionWarned, warn.Decide("203.0.113.7", "198.51.100.1"))
+	assert.True(t, warn.Decide("203.0.113.7", "198.51.100.1").Allowed())
+
+	off := strict.WithMode(utils.IPBindingOff)
+	assert.Equal(t, utils.IPDecisionSkipped, off.Decide("203.0.113.7", "198.51.100.1"))
+
+	mode, err := utils.ParseIPBindingMode("Same_Subnet")
+	assert.NoError(t, err)
+	assert.Equal(t, utils.IPBindingSameSubnet, mode)
+	_, err = utils.ParseIPBindingMode("lenient")
+	assert.Error(t, err)
+}
+
+func TestVerificationTokens(t *testing.T) {
+	key := utils.NewHMACKey("test-secret-key")
+	params := utils.EmailVerificationParams{
+		ID:      "0f6c1a3e-5a7e-4a52-9a43-3d8a1c3b7e11",
+		Subject: "6ab58fc3-6920-48a0-8851-a2f0650fa2a5",
+		Email:   "user@example.com",
+		Issuer:  "test-task",
+		TTL:     time.Hour,
+	}
+
+	token, err := utils.GenerateEmailVerificationToken(params, key)
+	assert.NoError(t, err)
+
+	claims, err := utils.VerifyEmailVerificationToken(token, key, "test-task")
+	assert.NoError(t, err)
+	assert.Equal(t, params.ID, claims.ID)
+	assert.Equal(t, params.Email, claims.Email)
+
+	_, err = utils.VerifyEmailVerificationToken(token, key, "other-issuer")
+	assert.ErrorIs(t, err, utils.ErrInvalidVerificationToken)
+	_, err = utils.VerifyEmailVerificationToken(token, utils.NewHMACKey("other-secret"), "test-task")
+	assert.ErrorIs(t, err, utils.ErrInvalidVerificationToken)
+
+	params.TTL = -time.Minute
+	expired, err := utils.GenerateEmailVerificationToken(params, key)
+	assert.NoError(t, err)
+	_, err = utils.VerifyEmailVerificationToken(expired, key, "test-task")
+	assert.ErrorIs(t, err, utils.ErrInvalidVerificationToken, "expected expired tokens to be rejected")
+
+	// the two kinds of token must not stand in for each other
+	accessToken, err := utils.GenerateAccessToken(utils.AccessTokenParams{UserID: params.Subject, Issuer: "test-task"}, key)
+	assert.NoError(t, err)
+	_, err = utils.VerifyEmailVerificationToken(accessToken, key, "test-task")
+	assert.ErrorIs(t, err, utils.ErrInvalidVerificationToken)
+	_, err = utils.ExtractUserIDFromToken(token, utils.TokenVerifier{Keys: key, Issuer: "test-task"})
+	assert.Error(t, err)
+
+	mode, err := utils.ParseEmailVerificationMode("Required")
+	assert.NoError(t, err)
+	assert.Equal(t, utils.EmailVerificationRequired, mode)
+	mode, err = utils.ParseEmailVerificationMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, utils.EmailVerificationOff, mode)
+	_, err = utils.ParseEmailVerificationMode("optional")
+	assert.Error(t, err)
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	rules := func(err error) []string {
+		var policyErr *utils.PasswordPolicyError
+		if !errors.As(err, &policyErr) {
+			return nil
+		}
+		var names []string
+		for _, violation := range policyErr.Violations {
+			names = append(names, violation.Rule)
+		}
+		return names
+	}
+
+	var zero utils.PasswordPolicy
+	assert.Equal(t, []string{utils.PasswordRuleMinLength}, rules(zero.Check("")), "expected empty passwords to be rejected")
+	assert.Equal(t, []string{utils.PasswordRuleMaxLength}, rules(zero.Check(strings.Repeat("ä", 37))), "expected passwords over 72 bytes to be rejected")
+	assert.NoError(t, zero.Check("password"))
+
+	policy := utils.PasswordPolicy{
+		MinLength:       10,
+		RequiredClasses: []string{utils.CharacterClassDigit, utils.CharacterClassSymbol},
+		BannedWords:     []string{"acme"},
+		MinStrength:     3,
+	}
+	assert.ElementsMatch(t, []string{utils.PasswordRuleMinLength, utils.PasswordRuleDigit, utils.PasswordRuleSymbol, utils.PasswordRuleStrength},
+		rules(policy.Check("password")))
+	assert.Equal(t, []string{utils.PasswordRuleBannedWord}, rules(policy.Check("Ac#e-4cm3-Rocket-91", "jane@example.com")),
+		"expected banned words to be found behind substitutions")
+	assert.Equal(t, []string{utils.PasswordRuleBannedWord}, rules(policy.Check("Tumble-j4n3.doe-77", "jane.doe@example.com")),
+		"expected the email local part to be banned")
+	assert.NoError(t, policy.Check("Tumble-Orbit-Saffron-77", "jane.doe@example.com"))
+
+	assert.Equal(t, 0, utils.PasswordStrength("aaaaaaaaaa"))
+	assert.Equal(t, 1, utils.PasswordStrength("P@ssw0rd1"))
+	assert.Equal(t, 1, utils.PasswordStrength("jane1985", "jane@example.com"))
+	assert.Equal(t, 4, utils.PasswordStrength("correct horse battery staple"))
+
+	// oversized input must not make scoring or checking expensive
+	long := strings.Repeat("pa$sw0rd-qwerty-1985-", 500)
+	started := time.Now()
+	assert.Equal(t, 4, utils.PasswordStrength(long, "jane@example.com"))
+	assert.Equal(t, []string{utils.PasswordRuleMaxLength}, rules(policy.Check(long, "jane@example.com")))
+	assert.Less(t, time.Since(started), 500*time.Millisecond, "expected long passwords to be scored quickly")
+
+	// a corpus of one range file, in the format of the range API
+	dir := t.TempDir()
+	digest := sha1.Sum([]byte("hunter2"))
+	hash := strings.ToUpper(hex.EncodeToString(digest[:]))
+	corpus := hash[5:] + ":17\r\n0018A45C4D1DEF81644B54AB7F969B88D65:0\r\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte(corpus), 0o600))
+
+	breached := utils.PasswordPolicy{Breached: utils.BreachedPasswordCorpus{Dir: dir}}
+	assert.Equal(t, []string{utils.PasswordRuleBreached}, rules(breached.Check("hunter2")))
+	assert.NoError(t, breached.Check("hunter3"), "expected prefixes without a file to pass")
+
+	rare := utils.PasswordPolicy{Breached: utils.BreachedPasswordCorpus{Dir: dir, MinCount: 100}}
+	assert.NoError(t, rare.Check("hunter2"), "expected passwords seen fewer than MinCount times to pass")
+
+	assert.Error(t, utils.ValidateCharacterClasses([]string{"emoji"}))
+}
+
+func TestClientIPResolver(t *testing.T) {
+	proxies, err := utils.ParseTrustedProxies([]string{"10.0.0.0/8", "2001:db8:ffff::1"})
+	assert.NoError(t, err)
+	_, err = utils.ParseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+
+	header := func(name, value string) http.Header {
+		h := http.Header{}
+		h.Set(name, value)
+		return h
+	}
+
+	resolver := utils.ClientIPResolver{TrustedProxies: proxies, Header: utils.HeaderXForwardedFor}
+	assert.Equal(t, "203.0.113.7", resolver.Resolve("10.0.0.2:4711", header("X-Forwarded-For", "198.51.100.1, 203.0.113.7, 10.0.0.5")),
+		"expected the nearest untrusted hop to be the client")
+	assert.Equal(t, "198.51.100.9", resolver.Resolve("198.51.100.9:4711", header("X-Forwarded-For", "203.0.113.7")),
+		"expected headers of untrusted peers to be ignored")
+	assert.Equal(t, "203.0.113.7", resolver.Resolve("[::ffff:10.0.0.2]:4711", header("X-Forwarded-For", "::ffff:203.0.113.7")))
+	assert.Equal(t, "10.0.0.2", resolver.Resolve("10.0.0.2:4711", header("X-Real-IP", "203.0.113.7")),
+		"expected headers other than the configured one to be ignored")
+
+	forwarded := utils.ClientIPResolver{TrustedProxies: proxies, Header: utils.HeaderForwarded}
+	assert.Equal(t, "2001:db8::7", forwarded.Resolve("[2001:db8:ffff::1]:443", header("Forwarded", `for="[2001:db8::7]:4711";proto=https, for=10.0.0.5`)))
+	assert.Equal(t, "10.0.0.5", forwarded.Resolve("10.0.0.2:4711", header("Forwarded", "for=_hidden, for=10.0.0.5")),
+		"expected an obfuscated hop to leave the last proxy as the client")
+
+	realIP := utils.ClientIPResolver{TrustedProxies: proxies, Header: utils.HeaderXRealIP}
+	assert.Equal(t, "203.0.113.7", realIP.Resolve("10.0.0.2:4711", header("X-Real-IP", "203.0.113.7")))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	read := func(data []byte) (string, string, error) {
+		reader := bufio.NewReader(bytes.NewReader(data))
+		addr, err := utils.ReadProxyHeader(reader)
+		rest, _ := io.ReadAll(reader)
+		if addr == nil {
+			return "", string(rest), err
+		}
+		return addr.String(), string(rest), err
+	}
+
+	addr, rest, err := read([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nGET / HTTP/1.1\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.7:51234", addr)
+	assert.Equal(t, "GET / HTTP/1.1\r\n", rest, "expected the request after the header to be left unread")
+
+	addr, rest, err = read([]byte("POST / HTTP/1.1\r\n"))
+	assert.NoError(t, err)
+	assert.Empty(t, addr)
+	assert.Equal(t, "POST / HTTP/1.1\r\n", rest, "expected connections without a header to pass through")
+
+	_, _, err = read([]byte("PROXY TCP4 not-an-ip 10.0.0.1 51234 443\r\n"))
+	assert.ErrorIs(t, err, utils.ErrInvalidProxyHeader)
+
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	v2 = append(v2, 0x21, 0x21, 0x00, 36)
+	v2 = append(v2, net.ParseIP("2001:db8::7").To16()...)
+	v2 = append(v2, net.ParseIP("2001:db8::1").To16()...)
+	v2 = append(v2, 0x12, 0x34, 0x01, 0xbb)
+	addr, rest, err = read(append(v2, []byte("GET /")...))
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::7]:4660", addr)
+	assert.Equal(t, "GET /", rest)
+
+	local := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20, 0x00, 0x00, 0x00)
+	addr, _, err = read(local)
+	assert.NoError(t, err)
+	assert.Empty(t, addr, "expected LOCAL headers to keep the peer address")
+}
+
+func TestCorsAllowsDPoP(t *testing.T) {
+	app := gin.New()
+	app.Use(initializer.CorsConfig(&config.Config{}))
+	app.POST("/token", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req := httptest.NewRequest(http.MethodOptions, "/token", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	req.Header.Set("Access-Control-Request-Headers", "content-type, dpop")
+	recorder := httptest.NewRecorder()
+	app.ServeHTTP(recorder, req)
+
+	assert.Less(t, recorder.Code, 300, "expected the preflight to succeed")
+	assert.Contains(t, strings.ToLower(recorder.Header().Get("Access-Control-Allow-Headers")), "dpop")
+}
+
+func TestRunPeriodically(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := make(chan struct{}, 3)
+	done := make(chan struct{})
+	go func() {
+		utils.RunPeriodically(ctx, "test task", 5*time.Millisecond, func() error {
+			runs <- struct{}{}
+			if len(runs) == cap(runs) {
+				cancel()
+			}
+			return errors.New("failures do not stop the task")
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("task did not run periodically")
+	}
+	assert.Equal(t, 3, len(runs))
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	proxies, _ := utils.ParseTrustedProxies([]string{"127.0.0.1"})
+	listener := &utils.ProxyProtocolListener{Listener: inner, Trusted: utils.ClientIPResolver{TrustedProxies: proxies}.Trusted}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", inner.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 51234 8080\r\nping"))
+	assert.NoError(t, err)
+
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "203.0.113.7:51234", conn.RemoteAddr().String())
+
+	data := make([]byte, 4)
+	_, err = io.ReadFull(conn, data)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(data))
+}